@@ -0,0 +1,7 @@
+// Package cloudyelastic implements the cloudy JSON data store and indexer on
+// Elastic Search.
+//
+// It needs Elastic Search 7.15 or later. Cursors, and so GetAll, Iterate,
+// ListDeleted and ListHistory, page with a point in time and the _shard_doc
+// tiebreaker, and SlicedExport slices the point in time, which 7.15 added.
+package cloudyelastic
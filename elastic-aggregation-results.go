@@ -0,0 +1,237 @@
+package cloudyelastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrAggregationNotFound is returned when a response has no aggregation
+// with the requested name
+var ErrAggregationNotFound = errors.New("aggregation not found")
+
+// AggregationResults are the results of the aggregations of a search or of
+// a bucket, by name. Read them with the method matching the aggregation
+//
+//	results, err := res.AggregationResults()
+//	buckets, err := results.Buckets("by_owner")
+//	for _, bucket := range buckets.Buckets {
+//		avg, err := bucket.Aggregations.Value("avg_size")
+//	}
+type AggregationResults map[string]json.RawMessage
+
+// DecodeAggregations decodes the aggregations of a search response
+func DecodeAggregations(data json.RawMessage) (AggregationResults, error) {
+	rtn := make(AggregationResults)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return rtn, nil
+	}
+	if err := json.Unmarshal(data, &rtn); err != nil {
+		return nil, fmt.Errorf("error parsing the aggregations: %s", err)
+	}
+	return rtn, nil
+}
+
+// AggregationResults decodes the aggregations of the response
+func (r *SearchResponse[T]) AggregationResults() (AggregationResults, error) {
+	return DecodeAggregations(r.Aggregations)
+}
+
+// Bucket is a single bucket of a bucket aggregation. Key is a string for
+// terms of strings and for filters, and a float64 otherwise. The results of
+// the sub-aggregations are in Aggregations
+type Bucket struct {
+	Key          interface{}
+	KeyAsString  string
+	DocCount     int64
+	From         *float64
+	To           *float64
+	Aggregations AggregationResults
+}
+
+// KeyString returns the key of the bucket as a string, the formatted key
+// when there is one
+func (b *Bucket) KeyString() string {
+	if b.KeyAsString != "" {
+		return b.KeyAsString
+	}
+	if f, ok := b.Key.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(b.Key)
+}
+
+func (b *Bucket) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	b.Aggregations = make(AggregationResults)
+	for name, value := range fields {
+		var err error
+		switch name {
+		case "key":
+			err = json.Unmarshal(value, &b.Key)
+		case "key_as_string":
+			err = json.Unmarshal(value, &b.KeyAsString)
+		case "doc_count":
+			err = json.Unmarshal(value, &b.DocCount)
+		case "from":
+			err = json.Unmarshal(value, &b.From)
+		case "to":
+			err = json.Unmarshal(value, &b.To)
+		case "from_as_string", "to_as_string":
+		default:
+			// Everything else is a sub-aggregation
+			if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+				b.Aggregations[name] = value
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing the bucket field %v: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// BucketResults are the results of a terms, histogram, date_histogram,
+// range or filters aggregation
+type BucketResults struct {
+	Buckets []*Bucket
+	// Only set for terms aggregations
+	DocCountErrorUpperBound int64
+	SumOtherDocCount        int64
+}
+
+// Bucket returns the bucket with the key, nil when there is none
+func (r *BucketResults) Bucket(key string) *Bucket {
+	for _, bucket := range r.Buckets {
+		if bucket.KeyString() == key {
+			return bucket
+		}
+	}
+	return nil
+}
+
+func (r *BucketResults) UnmarshalJSON(data []byte) error {
+	var res struct {
+		Buckets                 json.RawMessage `json:"buckets"`
+		DocCountErrorUpperBound int64           `json:"doc_count_error_upper_bound"`
+		SumOtherDocCount        int64           `json:"sum_other_doc_count"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	r.DocCountErrorUpperBound = res.DocCountErrorUpperBound
+	r.SumOtherDocCount = res.SumOtherDocCount
+
+	if len(res.Buckets) == 0 {
+		return errors.New("not a bucket aggregation")
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(res.Buckets), []byte("{")) {
+		return json.Unmarshal(res.Buckets, &r.Buckets)
+	}
+
+	// Keyed buckets, as returned by filters, are sorted by key
+	var keyed map[string]*Bucket
+	if err := json.Unmarshal(res.Buckets, &keyed); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(keyed))
+	for key := range keyed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	r.Buckets = make([]*Bucket, len(keys))
+	for i, key := range keys {
+		bucket := keyed[key]
+		bucket.Key = key
+		r.Buckets[i] = bucket
+	}
+	return nil
+}
+
+// MetricValue is the result of a single value metric aggregation. Value is
+// nil when no document had the field
+type MetricValue struct {
+	Value         *float64 `json:"value"`
+	ValueAsString string   `json:"value_as_string,omitempty"`
+}
+
+// StatsResults are the results of a stats aggregation. Min, Max and Avg are
+// nil when no document had the field
+type StatsResults struct {
+	Count int64    `json:"count"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+	Sum   float64  `json:"sum"`
+}
+
+// PercentilesResults are the results of a percentiles aggregation, by
+// percent as formatted by Elastic Search, e.g. "99.0"
+type PercentilesResults struct {
+	Values map[string]*float64 `json:"values"`
+}
+
+// Percentile returns the value of the percent, nil when it was not computed
+// or no document had the field
+func (r *PercentilesResults) Percentile(percent float64) *float64 {
+	key := strconv.FormatFloat(percent, 'f', -1, 64)
+	if !strings.Contains(key, ".") {
+		key += ".0"
+	}
+	return r.Values[key]
+}
+
+// Buckets returns the results of a bucket aggregation
+func (a AggregationResults) Buckets(name string) (*BucketResults, error) {
+	rtn := &BucketResults{}
+	if err := a.decode(name, rtn); err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+// Value returns the result of an avg, sum, min, max, value_count or
+// cardinality aggregation
+func (a AggregationResults) Value(name string) (*MetricValue, error) {
+	rtn := &MetricValue{}
+	if err := a.decode(name, rtn); err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+// Stats returns the results of a stats aggregation
+func (a AggregationResults) Stats(name string) (*StatsResults, error) {
+	rtn := &StatsResults{}
+	if err := a.decode(name, rtn); err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+// Percentiles returns the results of a percentiles aggregation
+func (a AggregationResults) Percentiles(name string) (*PercentilesResults, error) {
+	rtn := &PercentilesResults{}
+	if err := a.decode(name, rtn); err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
+
+func (a AggregationResults) decode(name string, v interface{}) error {
+	data, ok := a[name]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrAggregationNotFound, name)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing the aggregation %v: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package cloudyelastic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+)
+
+const (
+	BulkActionIndex  = "index"
+	BulkActionCreate = "create"
+	BulkActionUpdate = "update"
+	BulkActionDelete = "delete"
+)
+
+// BulkOptions controls how bulk writes are batched and sent to Elastic Search
+type BulkOptions struct {
+	// Approximate number of documents per bulk request. Unless FlushBytes is
+	// set, the flush threshold is derived from it and the average size of
+	// the documents. Defaults to 1000
+	BatchSize int
+	// Flush threshold in bytes, which takes precedence over BatchSize.
+	// Defaults to 5MB when neither is set
+	FlushBytes int
+	// Flush threshold as a duration. Defaults to 30 seconds
+	FlushInterval time.Duration
+	// Number of concurrent workers. Defaults to the number of CPUs
+	NumWorkers int
+	// Refresh policy applied to every bulk request. ElasticJsonDataStore and
+	// ESIndexer default it to their own Refresh, RefreshImmediate unless set,
+	// and WithRefresh overrides it per call. Bulk itself sends no refresh when
+	// it is empty
+	Refresh RefreshPolicy
+	// Default routing of the items that do not have their own
+	Routing string
+}
+
+// DefaultBulkOptions returns the options used when none are provided
+func DefaultBulkOptions() *BulkOptions {
+	return &BulkOptions{
+		BatchSize: 1000,
+	}
+}
+
+// BulkItem is a single operation in a bulk request. Data is ignored for deletes
+type BulkItem struct {
+	Action  string
+	ID      string
+	Routing string
+	Data    []byte
+	// External version of the document, used with VersionType external or
+	// external_gte
+	Version     *int64
+	VersionType string
+}
+
+// BulkItemError describes an item that Elastic Search rejected
+type BulkItemError struct {
+	ID     string
+	Action string
+	Status int
+	Type   string
+	Reason string
+	// The item was externally versioned and the stored document already
+	// had the same or a newer version
+	Stale bool
+}
+
+func (e *BulkItemError) Error() string {
+	return fmt.Sprintf("[%v] error in bulk %v of document ID=%v: %v %v", e.Status, e.Action, e.ID, e.Type, e.Reason)
+}
+
+// BulkStats are the aggregated statistics of a bulk operation
+type BulkStats struct {
+	NumAdded    uint64
+	NumFlushed  uint64
+	NumFailed   uint64
+	NumIndexed  uint64
+	NumCreated  uint64
+	NumUpdated  uint64
+	NumDeleted  uint64
+	NumRequests uint64
+}
+
+func (s *BulkStats) add(other esutil.BulkIndexerStats) {
+	s.NumAdded += other.NumAdded
+	s.NumFlushed += other.NumFlushed
+	s.NumFailed += other.NumFailed
+	s.NumIndexed += other.NumIndexed
+	s.NumCreated += other.NumCreated
+	s.NumUpdated += other.NumUpdated
+	s.NumDeleted += other.NumDeleted
+	s.NumRequests += other.NumRequests
+}
+
+// BulkResult is the outcome of a bulk operation. Errors contains one entry
+// for every item that failed. The externally versioned items ignored because
+// the stored document was as new or newer are not failures, they are in
+// StaleItems instead. Stats.NumFailed counts both
+type BulkResult struct {
+	Stats      BulkStats
+	Errors     []*BulkItemError
+	StaleItems []*BulkItemError
+}
+
+// HasErrors reports whether any of the items failed, stale items aside
+func (r *BulkResult) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// Existing returns the IDs of the create-only items that were rejected
+// because the document already existed
+func (r *BulkResult) Existing() []string {
+	var rtn []string
+	for _, e := range r.Errors {
+		if e.Action == BulkActionCreate && e.Status == 409 {
+			rtn = append(rtn, e.ID)
+		}
+	}
+	return rtn
+}
+
+// Stale returns the IDs of the externally versioned items that were ignored
+// because the stored document already had the same or a newer version
+func (r *BulkResult) Stale() []string {
+	var rtn []string
+	for _, e := range r.StaleItems {
+		rtn = append(rtn, e.ID)
+	}
+	return rtn
+}
+
+// skipped returns the IDs of the items that were not written, failed or
+// stale
+func (r *BulkResult) skipped() map[string]bool {
+	rtn := make(map[string]bool)
+	if r == nil {
+		return rtn
+	}
+	for _, e := range r.Errors {
+		rtn[e.ID] = true
+	}
+	for _, e := range r.StaleItems {
+		rtn[e.ID] = true
+	}
+	return rtn
+}
+
+// Err combines all the item errors into a single error, or nil when all
+// the items succeeded. Stale items are not errors
+func (r *BulkResult) Err() error {
+	if !r.HasErrors() {
+		return nil
+	}
+	errs := cloudy.MultiError()
+	for _, e := range r.Errors {
+		errs.Append(e)
+	}
+	return errs.AsErr()
+}
+
+// Bulk sends all the items to the index using the bulk API. The items go
+// through a single bulk indexer, whose workers send the requests
+// concurrently. The returned result contains the per item errors and
+// statistics. An error is only returned when a request could not be
+// performed at all.
+func Bulk(ctx context.Context, client *elasticsearch.Client, indexName string, items []*BulkItem, opts *BulkOptions) (*BulkResult, error) {
+	if opts == nil {
+		opts = DefaultBulkOptions()
+	}
+
+	rtn := &BulkResult{}
+	var lock sync.Mutex
+	requestErrs := cloudy.MultiError()
+
+	onFailure := func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+		itemErr := &BulkItemError{
+			ID:     item.DocumentID,
+			Action: item.Action,
+			Status: res.Status,
+			Type:   res.Error.Type,
+			Reason: res.Error.Reason,
+			Stale:  res.Status == 409 && item.Version != nil && item.Action != BulkActionCreate,
+		}
+		if err != nil && itemErr.Reason == "" {
+			itemErr.Reason = err.Error()
+		}
+		lock.Lock()
+		if itemErr.Stale {
+			rtn.StaleItems = append(rtn.StaleItems, itemErr)
+		} else {
+			rtn.Errors = append(rtn.Errors, itemErr)
+		}
+		lock.Unlock()
+	}
+
+	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        client,
+		Index:         indexName,
+		NumWorkers:    opts.NumWorkers,
+		FlushBytes:    bulkFlushBytes(items, opts),
+		FlushInterval: opts.FlushInterval,
+		Refresh:       string(opts.Refresh),
+		Routing:       opts.Routing,
+		OnError: func(ctx context.Context, err error) {
+			lock.Lock()
+			requestErrs.Append(err)
+			lock.Unlock()
+		},
+	})
+	if err != nil {
+		return rtn, err
+	}
+
+	for _, item := range items {
+		biItem := esutil.BulkIndexerItem{
+			Action:      item.Action,
+			DocumentID:  item.ID,
+			Routing:     item.Routing,
+			Version:     item.Version,
+			VersionType: item.VersionType,
+			OnFailure:   onFailure,
+		}
+		if item.Action != BulkActionDelete {
+			biItem.Body = bytes.NewReader(item.Data)
+		}
+		err = bi.Add(ctx, biItem)
+		if err != nil {
+			bi.Close(ctx)
+			rtn.Stats.add(bi.Stats())
+			return rtn, err
+		}
+	}
+
+	err = bi.Close(ctx)
+	rtn.Stats.add(bi.Stats())
+	if err != nil {
+		return rtn, err
+	}
+	return rtn, requestErrs.AsErr()
+}
+
+// The approximate size of the action line of a bulk item, besides its ID
+// and routing
+const bulkActionBytes = 64
+
+// bulkFlushBytes returns the flush threshold of the bulk indexer. Unless set,
+// it is derived from the batch size and the average size of the items, so
+// that the requests hold about BatchSize items each
+func bulkFlushBytes(items []*BulkItem, opts *BulkOptions) int {
+	if opts.FlushBytes > 0 || opts.BatchSize <= 0 || len(items) == 0 {
+		return opts.FlushBytes
+	}
+	size := 0
+	for _, item := range items {
+		size += bulkActionBytes + len(item.ID) + len(item.Routing) + len(item.Data)
+	}
+	return opts.BatchSize * (size / len(items))
+}
+
+// resolveBulkOptions returns a copy of the options with the refresh policy
+// to use. The policy of the context wins over the one of the options, which
+// wins over the configured refresh policy
+func resolveBulkOptions(ctx context.Context, opts *BulkOptions, refresh RefreshPolicy) *BulkOptions {
+	rtn := DefaultBulkOptions()
+	if opts != nil {
+		*rtn = *opts
+	}
+	if rtn.Refresh == "" {
+		rtn.Refresh = refresh
+	}
+	rtn.Refresh = resolveWriteOptions(ctx, rtn.Refresh).Refresh
+	return rtn
+}
+
+// BulkIndexData indexes all the documents. The ids and data are matched by position
+func BulkIndexData(ctx context.Context, client *elasticsearch.Client, indexName string, ids []string, data [][]byte, opts *BulkOptions) (*BulkResult, error) {
+	if len(ids) != len(data) {
+		return nil, fmt.Errorf("mismatched bulk request, %v ids and %v documents", len(ids), len(data))
+	}
+	items := make([]*BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = &BulkItem{Action: BulkActionIndex, ID: id, Data: data[i]}
+	}
+	return Bulk(ctx, client, indexName, items, opts)
+}
+
+// BulkCreateData indexes the documents that do not exist yet. Documents that
+// already existed are reported by BulkResult.Existing
+func BulkCreateData(ctx context.Context, client *elasticsearch.Client, indexName string, ids []string, data [][]byte, opts *BulkOptions) (*BulkResult, error) {
+	if len(ids) != len(data) {
+		return nil, fmt.Errorf("mismatched bulk request, %v ids and %v documents", len(ids), len(data))
+	}
+	items := make([]*BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = &BulkItem{Action: BulkActionCreate, ID: id, Data: data[i]}
+	}
+	return Bulk(ctx, client, indexName, items, opts)
+}
+
+// BulkRemoveData removes all the documents with the given ids
+func BulkRemoveData(ctx context.Context, client *elasticsearch.Client, indexName string, ids []string, opts *BulkOptions) (*BulkResult, error) {
+	items := make([]*BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = &BulkItem{Action: BulkActionDelete, ID: id}
+	}
+	return Bulk(ctx, client, indexName, items, opts)
+}
@@ -0,0 +1,347 @@
+package cloudyelastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/appliedres/cloudy/datastore"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ByQueryOptions are the optional parameters of DeleteByQuery and UpdateByQuery
+type ByQueryOptions struct {
+	// Run as a background task. The response only contains the task ID,
+	// which can be polled with GetTask
+	Async bool
+	// Throttle the operation. Nil or -1 means no throttling
+	RequestsPerSecond *int
+	// Keep going when documents change while the operation runs. Conflicts
+	// are counted in the response instead of aborting
+	ProceedOnConflicts bool
+	// Refresh all the affected shards once the operation completes
+	Refresh bool
+	// Number of slices to split the operation into, 0 lets Elastic Search decide
+	Slices int
+	// Maximum number of documents to process
+	MaxDocs *int
+	Routing string
+	// Let the operation affect every document. Otherwise an empty or
+	// match_all query is refused with ErrUnrestrictedQuery
+	AllowMatchAll bool
+}
+
+// ByQueryRetries are the number of retries of a by query operation
+type ByQueryRetries struct {
+	Bulk   int64 `json:"bulk"`
+	Search int64 `json:"search"`
+}
+
+// ByQueryResponse summarizes a delete by query or update by query. When the
+// operation runs as a background task only Task is set
+type ByQueryResponse struct {
+	Task              string            `json:"task,omitempty"`
+	Took              int64             `json:"took"`
+	TimedOut          bool              `json:"timed_out"`
+	Total             int64             `json:"total"`
+	Updated           int64             `json:"updated"`
+	Created           int64             `json:"created"`
+	Deleted           int64             `json:"deleted"`
+	Batches           int64             `json:"batches"`
+	VersionConflicts  int64             `json:"version_conflicts"`
+	Noops             int64             `json:"noops"`
+	Retries           ByQueryRetries    `json:"retries"`
+	ThrottledMillis   int64             `json:"throttled_millis"`
+	RequestsPerSecond float64           `json:"requests_per_second"`
+	Failures          []json.RawMessage `json:"failures"`
+	// Reason the operation was cancelled, empty unless it was
+	Canceled string `json:"canceled,omitempty"`
+}
+
+// TaskStatus is the status of a background task. Status holds the progress
+// so far, Response the final summary once the task completed
+type TaskStatus struct {
+	ID        string
+	Completed bool
+	Status    *ByQueryResponse
+	Response  *ByQueryResponse
+	Error     json.RawMessage
+}
+
+// DeleteByQuery deletes all the documents matching the query. The query can
+// be a JSON string, an *ElasticSearchQueryBuilder or a *datastore.SimpleQuery.
+// A query matching every document is refused unless AllowMatchAll is set
+func DeleteByQuery(ctx context.Context, client *elasticsearch.Client, indexName string, query interface{}, opts *ByQueryOptions) (*ByQueryResponse, error) {
+	if opts == nil {
+		opts = &ByQueryOptions{}
+	}
+
+	body, err := byQueryBody(query)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.AllowMatchAll && matchesAll(body) {
+		return nil, ErrUnrestrictedQuery
+	}
+
+	req := esapi.DeleteByQueryRequest{
+		Index:             []string{indexName},
+		Body:              bytes.NewReader(body.Bytes()),
+		RequestsPerSecond: opts.RequestsPerSecond,
+		MaxDocs:           opts.MaxDocs,
+		WaitForCompletion: esBool(!opts.Async),
+		Refresh:           esBool(opts.Refresh),
+	}
+	if opts.ProceedOnConflicts {
+		req.Conflicts = "proceed"
+	}
+	if opts.Slices > 0 {
+		req.Slices = opts.Slices
+	}
+	if opts.Routing != "" {
+		req.Routing = []string{opts.Routing}
+	}
+
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	return parseByQueryResponse(res, "deleting")
+}
+
+// UpdateByQuery runs the script against all the documents matching the
+// query. The query can be a JSON string, an *ElasticSearchQueryBuilder or a
+// *datastore.SimpleQuery. A nil script re-indexes the documents as they are.
+// A query matching every document is refused unless AllowMatchAll is set
+func UpdateByQuery(ctx context.Context, client *elasticsearch.Client, indexName string, query interface{}, script *Script, opts *ByQueryOptions) (*ByQueryResponse, error) {
+	if opts == nil {
+		opts = &ByQueryOptions{}
+	}
+
+	body, err := byQueryBody(query)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.AllowMatchAll && matchesAll(body) {
+		return nil, ErrUnrestrictedQuery
+	}
+	if script != nil {
+		body.Set(script, "script")
+	}
+
+	req := esapi.UpdateByQueryRequest{
+		Index:             []string{indexName},
+		Body:              bytes.NewReader(body.Bytes()),
+		RequestsPerSecond: opts.RequestsPerSecond,
+		MaxDocs:           opts.MaxDocs,
+		WaitForCompletion: esBool(!opts.Async),
+		Refresh:           esBool(opts.Refresh),
+	}
+	if opts.ProceedOnConflicts {
+		req.Conflicts = "proceed"
+	}
+	if opts.Slices > 0 {
+		req.Slices = opts.Slices
+	}
+	if opts.Routing != "" {
+		req.Routing = []string{opts.Routing}
+	}
+
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	return parseByQueryResponse(res, "updating")
+}
+
+// GetTask retrieves the status of a background task
+func GetTask(ctx context.Context, client *elasticsearch.Client, taskID string) (*TaskStatus, error) {
+	req := esapi.TasksGetRequest{
+		TaskID: taskID,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error getting task %v: %w", taskID, responseError(res, "", ""))
+	}
+
+	var result struct {
+		Completed bool `json:"completed"`
+		Task      struct {
+			Status *ByQueryResponse `json:"status"`
+		} `json:"task"`
+		Response *ByQueryResponse `json:"response"`
+		Error    json.RawMessage  `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	return &TaskStatus{
+		ID:        taskID,
+		Completed: result.Completed,
+		Status:    result.Task.Status,
+		Response:  result.Response,
+		Error:     result.Error,
+	}, nil
+}
+
+// WaitForTask polls the task until it completes or the context is done
+func WaitForTask(ctx context.Context, client *elasticsearch.Client, taskID string, interval time.Duration) (*TaskStatus, error) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status, err := GetTask(ctx, client, taskID)
+		if err != nil {
+			return nil, err
+		}
+		if status.Completed {
+			if status.Error != nil {
+				return status, fmt.Errorf("task %v failed, %v", taskID, string(status.Error))
+			}
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CancelTask cancels a background task
+func CancelTask(ctx context.Context, client *elasticsearch.Client, taskID string) error {
+	req := esapi.TasksCancelRequest{
+		TaskID: taskID,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error cancelling task %v: %w", taskID, responseError(res, "", ""))
+	}
+	return nil
+}
+
+// RethrottleDeleteByQuery changes the throttling of a running delete by
+// query task. Use -1 to disable throttling
+func RethrottleDeleteByQuery(ctx context.Context, client *elasticsearch.Client, taskID string, requestsPerSecond int) error {
+	req := esapi.DeleteByQueryRethrottleRequest{
+		TaskID:            taskID,
+		RequestsPerSecond: &requestsPerSecond,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error rethrottling task %v: %w", taskID, responseError(res, "", ""))
+	}
+	return nil
+}
+
+// RethrottleUpdateByQuery changes the throttling of a running update by
+// query task. Use -1 to disable throttling
+func RethrottleUpdateByQuery(ctx context.Context, client *elasticsearch.Client, taskID string, requestsPerSecond int) error {
+	req := esapi.UpdateByQueryRethrottleRequest{
+		TaskID:            taskID,
+		RequestsPerSecond: &requestsPerSecond,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error rethrottling task %v: %w", taskID, responseError(res, "", ""))
+	}
+	return nil
+}
+
+// byQueryBody builds the body of a by query request, which only keeps the
+// query of the provided query
+func byQueryBody(query interface{}) (*gabs.Container, error) {
+	var parsed *gabs.Container
+	switch q := query.(type) {
+	case nil:
+		parsed = gabs.New()
+	case string:
+		container, err := gabs.ParseJSON([]byte(q))
+		if err != nil {
+			return nil, err
+		}
+		parsed = container
+	case *ElasticSearchQueryBuilder:
+		parsed = q.BuildContainer()
+	case *datastore.SimpleQuery:
+		converted, err := new(ElasticQueryConverter).ConvertBuilder(q)
+		if err != nil {
+			return nil, err
+		}
+		parsed = converted.BuildContainer()
+	default:
+		return nil, fmt.Errorf("unsupported query type %T", query)
+	}
+
+	// Builders nest containers, reparse them so the query holds plain values
+	parsed, err := gabs.ParseJSON(parsed.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	body := gabs.New()
+	if q := parsed.S("query"); q != nil {
+		body.Set(q.Data(), "query")
+	} else {
+		body.Set(struct{}{}, "query", "match_all")
+	}
+	return body, nil
+}
+
+// matchesAll reports whether the query of the body is empty or match_all
+func matchesAll(body *gabs.Container) bool {
+	query, ok := body.S("query").Data().(map[string]interface{})
+	if !ok || len(query) == 0 {
+		return true
+	}
+	_, ok = query["match_all"]
+	return ok && len(query) == 1
+}
+
+func parseByQueryResponse(res *esapi.Response, action string) (*ByQueryResponse, error) {
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error %v by query: %w", action, responseError(res, "", ""))
+	}
+
+	result := &ByQueryResponse{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+	return result, nil
+}
+
+func esBool(v bool) *bool {
+	return &v
+}
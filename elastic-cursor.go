@@ -0,0 +1,318 @@
+package cloudyelastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// The tiebreaker appended to the sort of every cursor, so that documents
+// with the same sort values are neither skipped nor repeated between pages
+const shardDocTiebreaker = "_shard_doc"
+
+// CursorOptions are the optional parameters of a cursor
+type CursorOptions struct {
+	// Number of documents loaded per request. Defaults to 1000
+	PageSize int
+	// How long the point in time is kept between two pages. Defaults to a minute
+	KeepAlive time.Duration
+	Routing   string
+}
+
+// Cursor iterates over all the documents matching a query, however many
+// there are. The documents are paged with search_after under a point in
+// time, which gives a consistent view of the index while iterating. The
+// point in time is closed when the iteration ends, or by Close.
+//
+//	cursor, err := OpenCursor[Item](ctx, client, index, query, nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer cursor.Close()
+//	for cursor.Next() {
+//		item := cursor.Value()
+//	}
+//	return cursor.Err()
+type Cursor[T any] struct {
+	ctx       context.Context
+	client    *elasticsearch.Client
+	body      *gabs.Container
+	pageSize  int
+	keepAlive string
+	decode    func(data []byte) (*SearchResponse[T], error)
+
+	pitID       string
+	searchAfter []json.RawMessage
+	page        []*SearchHit[T]
+	pos         int
+	last        bool
+	err         error
+}
+
+// OpenCursor opens a cursor over the documents of the index matching the
+// query. The size and from of the query are ignored, the sort is kept.
+func OpenCursor[T any](ctx context.Context, client *elasticsearch.Client, indexName string, query *ElasticSearchQueryBuilder, opts *CursorOptions) (*Cursor[T], error) {
+	if query == nil {
+		query = NewQuery()
+	}
+	return openCursor(ctx, client, indexName, query.BuildContainer(), opts, DecodeSearchResponse[T])
+}
+
+func openCursor[T any](ctx context.Context, client *elasticsearch.Client, indexName string, body *gabs.Container, opts *CursorOptions, decode func(data []byte) (*SearchResponse[T], error)) (*Cursor[T], error) {
+	if opts == nil {
+		opts = &CursorOptions{}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = time.Minute
+	}
+
+	c := &Cursor[T]{
+		ctx:       ctx,
+		client:    client,
+		body:      cursorBody(body),
+		pageSize:  pageSize,
+		keepAlive: fmt.Sprintf("%dms", keepAlive.Milliseconds()),
+		decode:    decode,
+	}
+
+	pitID, err := openPointInTime(ctx, client, indexName, c.keepAlive, opts.Routing)
+	if err != nil {
+		return nil, err
+	}
+	c.pitID = pitID
+	return c, nil
+}
+
+func openPointInTime(ctx context.Context, client *elasticsearch.Client, indexName string, keepAlive string, routing string) (string, error) {
+	req := esapi.OpenPointInTimeRequest{
+		Index:     []string{indexName},
+		KeepAlive: keepAlive,
+		Routing:   routing,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return "", fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", responseError(res, indexName, "")
+	}
+
+	var pit struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&pit); err != nil {
+		return "", fmt.Errorf("error parsing the response body: %s", err)
+	}
+	return pit.ID, nil
+}
+
+// closePointInTime releases the point in time. It uses a fresh context so
+// the point in time is released even when the context was cancelled
+func closePointInTime(client *elasticsearch.Client, pitID string) error {
+	body, err := json.Marshal(map[string]string{"id": pitID})
+	if err != nil {
+		return err
+	}
+	req := esapi.ClosePointInTimeRequest{
+		Body: bytes.NewReader(body),
+	}
+	res, err := req.Do(context.Background(), client)
+	if err != nil {
+		return fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != 404 {
+		return responseError(res, "", "")
+	}
+	return nil
+}
+
+// searchPointInTime loads the page of the point in time after the sort
+// values. The body provides the query, sort and any other parameters
+func searchPointInTime(ctx context.Context, client *elasticsearch.Client, body *gabs.Container, pitID string, keepAlive string, size int, searchAfter []json.RawMessage, trackTotal bool) ([]byte, error) {
+	page, err := gabs.ParseJSON(body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	page.Set(size, "size")
+	page.Set(pitID, "pit", "id")
+	page.Set(keepAlive, "pit", "keep_alive")
+	if searchAfter != nil {
+		page.Set(searchAfter, "search_after")
+	}
+
+	req := esapi.SearchRequest{
+		Body:           bytes.NewReader(page.Bytes()),
+		TrackTotalHits: trackTotal,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, responseError(res, "", "")
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// cursorBody keeps the query and the sort of the body, with the tiebreaker
+// appended to the sort
+func cursorBody(body *gabs.Container) *gabs.Container {
+	rtn := gabs.New()
+	if query := body.S("query"); query != nil {
+		rtn.Set(query.Data(), "query")
+	}
+	if source := body.S("_source"); source != nil {
+		rtn.Set(source.Data(), "_source")
+	}
+	if highlight := body.S("highlight"); highlight != nil {
+		rtn.Set(highlight.Data(), "highlight")
+	}
+
+	hasTiebreaker := false
+	for _, sort := range body.S("sort").Children() {
+		if sort.Exists(shardDocTiebreaker) || sort.Data() == shardDocTiebreaker {
+			hasTiebreaker = true
+		}
+		rtn.ArrayAppend(sort.Data(), "sort")
+	}
+	if !hasTiebreaker {
+		rtn.ArrayAppend(map[string]interface{}{
+			shardDocTiebreaker: map[string]interface{}{"order": "asc"},
+		}, "sort")
+	}
+	return rtn
+}
+
+// Next advances to the next document, loading the next page when needed.
+// It returns false when there are no more documents or an error occurred
+func (c *Cursor[T]) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	c.pos++
+	if c.pos < len(c.page) {
+		return true
+	}
+	if c.last || c.pitID == "" {
+		c.Close()
+		return false
+	}
+
+	if err := c.loadPage(); err != nil {
+		c.err = err
+		c.Close()
+		return false
+	}
+	if len(c.page) == 0 {
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// Value returns the current document
+func (c *Cursor[T]) Value() *T {
+	if hit := c.Hit(); hit != nil {
+		return hit.Source
+	}
+	return nil
+}
+
+// Hit returns the current hit, with its ID and sort values
+func (c *Cursor[T]) Hit() *SearchHit[T] {
+	if c.pos < 0 || c.pos >= len(c.page) {
+		return nil
+	}
+	return c.page[c.pos]
+}
+
+// Err returns the error that ended the iteration, if any
+func (c *Cursor[T]) Err() error {
+	return c.err
+}
+
+// Close releases the point in time. It is safe to call more than once
+func (c *Cursor[T]) Close() error {
+	if c.pitID == "" {
+		return nil
+	}
+	pitID := c.pitID
+	c.pitID = ""
+	return closePointInTime(c.client, pitID)
+}
+
+// readAll reads the cursor to the end and closes it. Hits without a source
+// become empty items, as in ParseResultsTyped
+func readAll[T any](cursor *Cursor[T]) ([]*T, error) {
+	defer cursor.Close()
+
+	var items []*T
+	for cursor.Next() {
+		item := cursor.Value()
+		if item == nil {
+			item = new(T)
+		}
+		items = append(items, item)
+	}
+	return items, cursor.Err()
+}
+
+func (c *Cursor[T]) loadPage() error {
+	data, err := searchPointInTime(c.ctx, c.client, c.body, c.pitID, c.keepAlive, c.pageSize, c.searchAfter, false)
+	if err != nil {
+		return err
+	}
+	page, err := c.decode(data)
+	if err != nil {
+		return err
+	}
+
+	if page.PitID != "" {
+		c.pitID = page.PitID
+	}
+	c.page = page.Hits.Hits
+	c.pos = 0
+	c.last = len(c.page) < c.pageSize
+	if len(c.page) > 0 {
+		c.searchAfter, err = lastSortValues(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastSortValues returns the sort values of the last hit exactly as they
+// were returned, decoding them as float64 would lose the precision of longs
+func lastSortValues(data []byte) ([]json.RawMessage, error) {
+	var res struct {
+		Hits struct {
+			Hits []struct {
+				Sort []json.RawMessage `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+	hits := res.Hits.Hits
+	if len(hits) == 0 {
+		return nil, nil
+	}
+	return hits[len(hits)-1].Sort, nil
+}
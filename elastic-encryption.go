@@ -0,0 +1,296 @@
+package cloudyelastic
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+const (
+	// Tag option of the fields to encrypt
+	tagEncrypt = "encrypt"
+	// Tag option of the encrypted fields that need exact-match lookups,
+	// which are encrypted deterministically
+	tagSearchable = "searchable"
+
+	encryptedPrefix     = "enc:v2:"
+	deterministicPrefix = "enc:d2:"
+
+	// Prefixes of the values encrypted before the field path was
+	// authenticated, which are still decrypted
+	legacyEncryptedPrefix     = "enc:v1:"
+	legacyDeterministicPrefix = "enc:d1:"
+
+	// HKDF info of the keys derived for each purpose
+	encryptionKeyInfo = "cloudy-elastic encryption"
+	macKeyInfo        = "cloudy-elastic mac"
+)
+
+// ErrUnknownKey is returned when a value was encrypted with a key the key
+// provider does not know
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// ErrNotEncrypted is returned when decrypting a value that is not encrypted
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+// KeyProvider supplies the keys used for field-level encryption. Every
+// encrypted value records the ID of its key so that keys can be rotated.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new values
+	CurrentKey(ctx context.Context) (string, []byte, error)
+	// Key returns the key with the ID, used to decrypt existing values
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// FieldEncryptor encrypts and decrypts the values of tagged fields. The
+// field is the path of the field in the document, and a value only decrypts
+// for the field it was encrypted for. Deterministic encryption always
+// produces the same output for the same field, input and key, which allows
+// exact-match lookups.
+type FieldEncryptor interface {
+	Encrypt(ctx context.Context, field string, plaintext string, deterministic bool) (string, error)
+	Decrypt(ctx context.Context, field string, value string) (string, error)
+}
+
+// StaticKeyProvider is a KeyProvider backed by an in-memory set of keys
+type StaticKeyProvider struct {
+	CurrentID string
+	Keys      map[string][]byte
+}
+
+func NewStaticKeyProvider(currentID string, keys map[string][]byte) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		CurrentID: currentID,
+		Keys:      keys,
+	}
+}
+
+func (kp *StaticKeyProvider) CurrentKey(ctx context.Context) (string, []byte, error) {
+	key, err := kp.Key(ctx, kp.CurrentID)
+	return kp.CurrentID, key, err
+}
+
+func (kp *StaticKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := kp.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// AESGCMEncryptor is the default FieldEncryptor. Values are encrypted with
+// AES-GCM using 16, 24 or 32 byte keys, authenticating the key ID and the
+// field path so that values cannot be moved between fields. The document
+// key is not authenticated, as Elastic Search assigned keys are only known
+// once the document is written. Deterministic values derive their nonce from
+// an HMAC of the field path and the plaintext instead of a random nonce, so
+// equal values only show in the same field. Separate encryption and MAC keys
+// are derived from each key with HKDF.
+type AESGCMEncryptor struct {
+	Keys KeyProvider
+	// Decrypt returns the values that are not encrypted as they are, instead
+	// of ErrNotEncrypted. Only meant for migrating the documents stored
+	// before their fields were encrypted
+	AllowPlaintext bool
+}
+
+func NewAESGCMEncryptor(keys KeyProvider) *AESGCMEncryptor {
+	return &AESGCMEncryptor{
+		Keys: keys,
+	}
+}
+
+// Encrypt encrypts the value of the field into
+// "enc:<mode>:<key id>:<base64 nonce + ciphertext>"
+func (e *AESGCMEncryptor) Encrypt(ctx context.Context, field string, plaintext string, deterministic bool) (string, error) {
+	keyID, key, err := e.Keys.CurrentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(keyID, ":") {
+		return "", fmt.Errorf("invalid encryption key id %v", keyID)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := encryptedPrefix
+	nonce := make([]byte, gcm.NonceSize())
+	if deterministic {
+		prefix = deterministicPrefix
+		mac := hmac.New(sha256.New, deriveKey(key, macKeyInfo, sha256.Size))
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+		mac.Write([]byte(plaintext))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), associatedData(keyID, field))
+	return prefix + keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value of the field produced by Encrypt. ErrNotEncrypted
+// is returned for values that are not encrypted, unless AllowPlaintext is set
+func (e *AESGCMEncryptor) Decrypt(ctx context.Context, field string, value string) (string, error) {
+	var rest string
+	legacy := false
+	switch {
+	case strings.HasPrefix(value, encryptedPrefix):
+		rest = strings.TrimPrefix(value, encryptedPrefix)
+	case strings.HasPrefix(value, deterministicPrefix):
+		rest = strings.TrimPrefix(value, deterministicPrefix)
+	case strings.HasPrefix(value, legacyEncryptedPrefix):
+		rest, legacy = strings.TrimPrefix(value, legacyEncryptedPrefix), true
+	case strings.HasPrefix(value, legacyDeterministicPrefix):
+		rest, legacy = strings.TrimPrefix(value, legacyDeterministicPrefix), true
+	case e.AllowPlaintext:
+		return value, nil
+	default:
+		return "", ErrNotEncrypted
+	}
+
+	parts := strings.SplitN(rest, ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("invalid encrypted value")
+	}
+	keyID := parts[0]
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	key, err := e.Keys.Key(ctx, keyID)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+
+	additional := associatedData(keyID, field)
+	if legacy {
+		additional = []byte(keyID)
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// associatedData is the data authenticated along with a value. Key IDs never
+// contain a colon
+func associatedData(keyID string, field string) []byte {
+	return []byte(keyID + ":" + field)
+}
+
+// newGCM creates the cipher with the encryption key derived from the key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, aes.KeySizeError(len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, encryptionKeyInfo, len(key)))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a key of up to 32 bytes for one purpose from the key,
+// with HKDF-SHA256 (RFC 5869) and no salt
+func deriveKey(key []byte, info string, size int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:size]
+}
+
+// encryptFields encrypts the tagged fields in the JSON document
+func encryptFields(ctx context.Context, encryptor FieldEncryptor, fields []*taggedField, data []byte) ([]byte, error) {
+	return transformFields(fields, data, func(field *taggedField, value string) (string, error) {
+		return encryptor.Encrypt(ctx, field.QueryPath(), value, field.Has(tagSearchable))
+	})
+}
+
+// decryptFields decrypts the tagged fields in the JSON document
+func decryptFields(ctx context.Context, encryptor FieldEncryptor, fields []*taggedField, data []byte) ([]byte, error) {
+	return transformFields(fields, data, func(field *taggedField, value string) (string, error) {
+		return encryptor.Decrypt(ctx, field.QueryPath(), value)
+	})
+}
+
+func transformFields(fields []*taggedField, data []byte, transform func(field *taggedField, value string) (string, error)) ([]byte, error) {
+	if len(fields) == 0 || len(data) == 0 {
+		return data, nil
+	}
+
+	parsed, err := gabs.ParseJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		if err := transformPath(parsed, field, field.Path, transform); err != nil {
+			return nil, err
+		}
+	}
+
+	return parsed.Bytes(), nil
+}
+
+// transformPath transforms the value of the field at the path below the
+// container, following every element of the arrays and objects on the way
+func transformPath(container *gabs.Container, field *taggedField, path []string, transform func(field *taggedField, value string) (string, error)) error {
+	if container == nil || container.Data() == nil {
+		return nil
+	}
+
+	if path[0] == pathElements {
+		for _, child := range container.Children() {
+			if err := transformPath(child, field, path[1:], transform); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(path) > 1 {
+		return transformPath(container.S(path[0]), field, path[1:], transform)
+	}
+
+	child := container.S(path[0])
+	if child == nil || child.Data() == nil {
+		return nil
+	}
+	value, ok := child.Data().(string)
+	if !ok {
+		return fmt.Errorf("encrypted field %v must be a string", field.Name())
+	}
+	transformed, err := transform(field, value)
+	if err != nil {
+		return fmt.Errorf("field %v: %w", field.Name(), err)
+	}
+	container.Set(transformed, path[0])
+	return nil
+}
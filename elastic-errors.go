@@ -0,0 +1,215 @@
+package cloudyelastic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ErrIndexNotFound is returned when the index does not exist
+var ErrIndexNotFound = errors.New("index not found")
+
+// ErrUnsupportedCondition is returned when a condition of a
+// datastore.SimpleQuery cannot be converted into an Elastic Search query
+var ErrUnsupportedCondition = errors.New("unsupported query condition")
+
+// ErrUnrestrictedQuery is returned when a delete or update by query would
+// affect every document and ByQueryOptions.AllowMatchAll is not set
+var ErrUnrestrictedQuery = errors.New("query matches all the documents")
+
+// ErrExportExpired is returned when an export is resumed after its point in
+// time expired and its sort has no field to resume the position on
+var ErrExportExpired = errors.New("export point in time expired")
+
+// ErrUnsupportedVersion is returned when a feature needs a newer version of
+// Elastic Search than the cluster runs
+var ErrUnsupportedVersion = errors.New("unsupported Elastic Search version")
+
+// ErrTooManyRequests is returned when Elastic Search rejects a request
+// because it is overloaded. The request can be retried later
+var ErrTooManyRequests = errors.New("too many requests")
+
+// ErrorCause is the cause of an error as reported by Elastic Search
+type ErrorCause struct {
+	Type     string      `json:"type"`
+	Reason   string      `json:"reason"`
+	Index    string      `json:"index,omitempty"`
+	Shard    interface{} `json:"shard,omitempty"`
+	CausedBy *ErrorCause `json:"caused_by,omitempty"`
+}
+
+func (c *ErrorCause) String() string {
+	if c.CausedBy != nil {
+		return fmt.Sprintf("%v: %v, caused by %v", c.Type, c.Reason, c.CausedBy)
+	}
+	return fmt.Sprintf("%v: %v", c.Type, c.Reason)
+}
+
+// ShardFailure is the failure of a single shard during a search
+type ShardFailure struct {
+	Shard  int         `json:"shard"`
+	Index  string      `json:"index"`
+	Node   string      `json:"node"`
+	Reason *ErrorCause `json:"reason"`
+}
+
+// ElasticError is an error response from Elastic Search. Use errors.Is with
+// ErrNotFound, ErrIndexNotFound, ErrVersionConflict, ErrAlreadyExists,
+// ErrStaleVersion or ErrTooManyRequests to check what went wrong
+type ElasticError struct {
+	Status       int
+	Type         string
+	Reason       string
+	RootCauses   []*ErrorCause
+	CausedBy     *ErrorCause
+	FailedShards []*ShardFailure
+	Index        string
+	ID           string
+
+	// The sentinel error matched by errors.Is, beyond the ones derived from
+	// the status and type
+	kind error
+}
+
+func (e *ElasticError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%v]", e.Status)
+	if e.Type != "" {
+		fmt.Fprintf(&sb, " %v:", e.Type)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&sb, " %v", e.Reason)
+	} else if e.kind != nil {
+		fmt.Fprintf(&sb, " %v", e.kind)
+	}
+	if e.CausedBy != nil {
+		fmt.Fprintf(&sb, ", caused by %v", e.CausedBy)
+	}
+	if e.Index != "" {
+		fmt.Fprintf(&sb, " index=%v", e.Index)
+	}
+	if e.ID != "" {
+		fmt.Fprintf(&sb, " document ID=%v", e.ID)
+	}
+	return sb.String()
+}
+
+func (e *ElasticError) Is(target error) bool {
+	if e.kind != nil && target == e.kind {
+		return true
+	}
+	switch target {
+	case ErrIndexNotFound:
+		return e.indexMissing()
+	case ErrNotFound:
+		return e.Status == 404 && !e.indexMissing()
+	case ErrTooManyRequests:
+		return e.Status == 429
+	case ErrVersionConflict:
+		return e.Status == 409 && e.kind == nil
+	}
+	return false
+}
+
+func (e *ElasticError) indexMissing() bool {
+	if e.Type == "index_not_found_exception" {
+		return true
+	}
+	for _, cause := range e.RootCauses {
+		if cause.Type == "index_not_found_exception" {
+			return true
+		}
+	}
+	return false
+}
+
+// errorBody is the body of an error response. Error is either an object or,
+// for some older APIs, a plain string
+type errorBody struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type errorDetails struct {
+	ErrorCause
+	RootCause    []*ErrorCause   `json:"root_cause"`
+	FailedShards []*ShardFailure `json:"failed_shards"`
+}
+
+// responseError reads the error response into an ElasticError
+func responseError(res *esapi.Response, index string, ID string) *ElasticError {
+	var body []byte
+	if res.Body != nil {
+		body, _ = ioutil.ReadAll(res.Body)
+	}
+	return newElasticError(res.StatusCode, body, index, ID)
+}
+
+func newElasticError(status int, body []byte, index string, ID string) *ElasticError {
+	rtn := &ElasticError{
+		Status: status,
+		Index:  index,
+		ID:     ID,
+	}
+
+	var parsed errorBody
+	if len(body) > 0 && json.Unmarshal(body, &parsed) == nil && len(parsed.Error) > 0 {
+		rtn.setDetails(parsed.Error)
+	} else if len(body) > 0 && !json.Valid(body) {
+		rtn.Reason = strings.TrimSpace(string(body))
+	}
+
+	if status == 409 && strings.Contains(rtn.Reason, "document already exists") {
+		rtn.kind = ErrAlreadyExists
+	}
+	if status == 404 && rtn.Type == "" {
+		rtn.kind = ErrNotFound
+	}
+	return rtn
+}
+
+func (e *ElasticError) setDetails(data json.RawMessage) {
+	var reason string
+	if json.Unmarshal(data, &reason) == nil {
+		e.Reason = reason
+		return
+	}
+
+	var details errorDetails
+	if json.Unmarshal(data, &details) != nil {
+		e.Reason = string(data)
+		return
+	}
+	e.Type = details.Type
+	e.Reason = details.Reason
+	e.CausedBy = details.CausedBy
+	e.RootCauses = details.RootCause
+	e.FailedShards = details.FailedShards
+	if e.Index == "" {
+		e.Index = details.Index
+	}
+}
+
+// causeError converts the error of a single item of a multi document
+// response into an ElasticError
+func causeError(status int, cause *ErrorCause, index string, ID string) *ElasticError {
+	rtn := &ElasticError{
+		Status:   status,
+		Type:     cause.Type,
+		Reason:   cause.Reason,
+		CausedBy: cause.CausedBy,
+		Index:    index,
+		ID:       ID,
+	}
+	if cause.Index != "" {
+		rtn.Index = cause.Index
+	}
+	if rtn.Status == 0 && rtn.indexMissing() {
+		rtn.Status = 404
+	}
+	return rtn
+}
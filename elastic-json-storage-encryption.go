@@ -0,0 +1,47 @@
+package cloudyelastic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// EncryptedValue encrypts the value the way the encrypted field at the path
+// is stored, e.g. "email" or "notes.text". Values of fields tagged
+// `elastic:"encrypt,searchable"` can be used in an exact-match query, only
+// values encrypted with the current key match. It also encrypts the values
+// of partial updates, which are stored as provided
+func (st *ElasticJsonDataStore[T]) EncryptedValue(ctx context.Context, path string, value string) (string, error) {
+	fields, err := st.encryptedFields()
+	if err != nil {
+		return "", err
+	}
+	if st.Encryption == nil {
+		return "", errors.New("no encryption is configured")
+	}
+	for _, field := range fields {
+		if field.QueryPath() == path {
+			return st.Encryption.Encrypt(ctx, path, value, field.Has(tagSearchable))
+		}
+	}
+	return "", fmt.Errorf("%v is not an encrypted field", path)
+}
+
+// encryptedFields returns the fields of the model tagged for encryption
+func (st *ElasticJsonDataStore[T]) encryptedFields() ([]*taggedField, error) {
+	fields := taggedFieldsWith(reflect.TypeOf((*T)(nil)).Elem(), tagEncrypt)
+	for _, field := range fields {
+		t := field.Type
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.String {
+			return nil, fmt.Errorf("encrypted field %v must be a string", field.Name())
+		}
+	}
+	if len(fields) > 0 && st.Encryption == nil {
+		return nil, errors.New("the model has encrypted fields but no encryption is configured")
+	}
+	return fields, nil
+}
@@ -0,0 +1,157 @@
+package cloudyelastic
+
+import (
+	"context"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/appliedres/cloudy"
+)
+
+type ttlKey struct{}
+
+// WithTTL returns a context that saves items of ElasticJsonDataStore made
+// with it with the given time to live. Only applies to stores with expiry
+// enabled. A negative time to live removes the expiry of the items, while
+// saving without one keeps the expiry the stored item already had
+func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey{}, ttl)
+}
+
+// SaveWithTTL saves the item so that it expires after the time to live. The
+// store must have expiry enabled
+func (st *ElasticJsonDataStore[T]) SaveWithTTL(ctx context.Context, item *T, key string, ttl time.Duration) error {
+	return st.Save(WithTTL(ctx, ttl), item, key)
+}
+
+// DeleteExpired removes up to batchSize expired items. A batch size of 0
+// removes all of them
+func (st *ElasticJsonDataStore[T]) DeleteExpired(ctx context.Context, batchSize int) (*ByQueryResponse, error) {
+	query := NewQuery()
+	query.Query.Bool.Filter.Range(st.expiresAtField(), "", "now")
+
+	opts := &ByQueryOptions{
+		ProceedOnConflicts: true,
+	}
+	if batchSize > 0 {
+		opts.MaxDocs = &batchSize
+	}
+	return st.DeleteByQuery(ctx, query, opts)
+}
+
+// Reaper periodically removes the expired items of a store
+type Reaper struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartReaper starts removing expired items every interval, in batches of
+// batchSize, until the context is done or the reaper is stopped
+func (st *ElasticJsonDataStore[T]) StartReaper(ctx context.Context, interval time.Duration, batchSize int) *Reaper {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	reaper := &Reaper{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(reaper.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Keep going while full batches are removed
+			for ctx.Err() == nil {
+				resp, err := st.DeleteExpired(ctx, batchSize)
+				if err != nil {
+					cloudy.Warn(ctx, "Error removing expired items from %v: %v", st.Index, err)
+					break
+				}
+				if resp.Deleted < int64(batchSize) {
+					break
+				}
+			}
+		}
+	}()
+
+	return reaper
+}
+
+// Stop stops the reaper and waits for the current batch to finish
+func (r *Reaper) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+func (st *ElasticJsonDataStore[T]) expires() bool {
+	return st.Expires || st.TTL > 0
+}
+
+// ttl is the time to live of items saved with the context
+func (st *ElasticJsonDataStore[T]) ttl(ctx context.Context) time.Duration {
+	if ttl, ok := ctx.Value(ttlKey{}).(time.Duration); ok {
+		return ttl
+	}
+	return st.TTL
+}
+
+// currentExpiry loads the expiry of the stored documents of the keys, when
+// the items are saved without a time to live and should keep it
+func (st *ElasticJsonDataStore[T]) currentExpiry(ctx context.Context, keys []string, items []*T) (map[string]interface{}, error) {
+	if !st.expires() || st.ttl(ctx) != 0 {
+		return nil, nil
+	}
+
+	var ids, routings []string
+	for i, key := range keys {
+		if key == "" || items[i] == nil {
+			continue
+		}
+		ids = append(ids, key)
+		routings = append(routings, st.routing(ctx, key, items[i]))
+	}
+	docs, err := MultiLoadByIDRouted(ctx, st.Client, ids, routings, st.Index, &GetOptions{
+		SourceIncludes: []string{st.expiresAtField()},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rtn := make(map[string]interface{})
+	for _, doc := range docs {
+		if doc.Error != nil {
+			return nil, doc.Error
+		}
+		if !doc.Found {
+			continue
+		}
+		parsed, err := gabs.ParseJSON(doc.Source)
+		if err != nil {
+			return nil, err
+		}
+		if expiresAt := parsed.S(st.expiresAtField()); expiresAt != nil {
+			rtn[doc.ID] = expiresAt.Data()
+		}
+	}
+	return rtn, nil
+}
+
+func (st *ElasticJsonDataStore[T]) expiresAtField() string {
+	if st.ExpiresAtField == "" {
+		return "_expiresAt"
+	}
+	return st.ExpiresAtField
+}
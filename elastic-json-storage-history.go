@@ -0,0 +1,367 @@
+package cloudyelastic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+const (
+	HistoryOperationSave    = "save"
+	HistoryOperationUpdate  = "update"
+	HistoryOperationDelete  = "delete"
+	HistoryOperationRestore = "restore"
+)
+
+// The history index keeps the documents as-is, without indexing them
+const historyMapping = `{
+	"mappings": {
+		"properties": {
+			"key":       { "type": "keyword" },
+			"operation": { "type": "keyword" },
+			"user":      { "type": "keyword" },
+			"timestamp": { "type": "date" },
+			"existed":   { "type": "boolean" },
+			"version":   { "type": "long" },
+			"document":  { "type": "object", "enabled": false }
+		}
+	}
+}`
+
+// HistoryEntry records the state of an item before an operation changed it
+type HistoryEntry[T any] struct {
+	Key       string
+	Operation string
+	User      string
+	Timestamp time.Time
+	// The item before the operation, nil when it did not exist
+	Item    *T
+	Version int64
+}
+
+type historyRecord struct {
+	Key       string          `json:"key"`
+	Operation string          `json:"operation"`
+	User      string          `json:"user"`
+	Timestamp time.Time       `json:"timestamp"`
+	Existed   bool            `json:"existed"`
+	Version   int64           `json:"version,omitempty"`
+	Document  json.RawMessage `json:"document,omitempty"`
+}
+
+// ListHistory returns the history of the item, most recent change first,
+// paging through the history index with a cursor
+func (st *ElasticJsonDataStore[T]) ListHistory(ctx context.Context, key string) ([]*HistoryEntry[T], error) {
+	query := NewQuery()
+	query.Query.Bool.Filter.Terms("key", key)
+	query.AddSort("timestamp", "DESC")
+
+	cursor, err := OpenCursor[historyRecord](ctx, st.Client, st.historyIndex(), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readAll(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return st.historyEntries(ctx, records)
+}
+
+// GetAsOf returns the item as it was at the given time. ErrNotFound is
+// returned when the item did not exist at that time
+func (st *ElasticJsonDataStore[T]) GetAsOf(ctx context.Context, key string, at time.Time) (*T, error) {
+	// The first change after the time holds the version that was current then
+	query := NewQuery()
+	query.Size = 1
+	query.Query.Bool.Filter.Terms("key", key)
+	query.Query.Bool.Filter.RangeExt("timestamp", "", "", at.UTC().Format(time.RFC3339Nano), "")
+	query.AddSort("timestamp", "ASC")
+
+	results, err := QueryWithOptions(ctx, st.Client, st.historyIndex(), query.Build(), nil)
+	if err != nil {
+		return nil, err
+	}
+	records, err := ParseResultsTyped[historyRecord](results)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return st.MustGet(ctx, key)
+	}
+
+	record := records[0]
+	if !record.Existed {
+		return nil, fmt.Errorf("%w: document ID=%v at %v", ErrNotFound, key, at)
+	}
+	visible, err := st.visible(record.Document)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, fmt.Errorf("%w: document ID=%v at %v", ErrNotFound, key, at)
+	}
+	return st.unmarshal(ctx, record.Document)
+}
+
+func (st *ElasticJsonDataStore[T]) historyEntries(ctx context.Context, records []*historyRecord) ([]*HistoryEntry[T], error) {
+	var err error
+	rtn := make([]*HistoryEntry[T], len(records))
+	for i, record := range records {
+		entry := &HistoryEntry[T]{
+			Key:       record.Key,
+			Operation: record.Operation,
+			User:      record.User,
+			Timestamp: record.Timestamp,
+			Version:   record.Version,
+		}
+		if record.Existed {
+			entry.Item, err = st.unmarshal(ctx, record.Document)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rtn[i] = entry
+	}
+	return rtn, nil
+}
+
+func (st *ElasticJsonDataStore[T]) openHistory(ctx context.Context) error {
+	return CreateIndexWithMapping(st.Client, st.historyIndex(), historyMapping)
+}
+
+func (st *ElasticJsonDataStore[T]) historyIndex() string {
+	if st.HistoryIndex == "" {
+		return st.Index + "-history"
+	}
+	return st.HistoryIndex
+}
+
+// loadPrevious loads the current documents for the keys before they are
+// changed, when history is enabled
+func (st *ElasticJsonDataStore[T]) loadPrevious(ctx context.Context, keys []string) ([]*Document, error) {
+	if !st.History {
+		return nil, nil
+	}
+
+	routings := make([]string, len(keys))
+	for i, key := range keys {
+		routings[i] = st.routing(ctx, key, nil)
+	}
+	docs, err := MultiLoadByIDRouted(ctx, st.Client, keys, routings, st.Index, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if doc.Error != nil {
+			return nil, doc.Error
+		}
+	}
+	return docs, nil
+}
+
+// withHistory runs the write of a single document. With history enabled the
+// current document is recorded first and the write is conditioned on it, so
+// a concurrent change is never missing from the history. When another writer
+// got in between, the record is removed and the write is retried against
+// the new current document, up to ConflictRetries times
+func (st *ElasticJsonDataStore[T]) withHistory(ctx context.Context, operation string, key string, opts *WriteOptions, write func(opts *WriteOptions) error) error {
+	if !st.History {
+		return write(opts)
+	}
+
+	for attempt := 0; ; attempt++ {
+		previous, err := st.loadPrevious(ctx, []string{key})
+		if err != nil {
+			return err
+		}
+		records, err := st.recordHistory(ctx, operation, previous)
+		if err != nil {
+			return err
+		}
+
+		guarded := *opts
+		conditioned := guardWrite(&guarded, previous[0])
+		err = write(&guarded)
+		if err == nil {
+			return nil
+		}
+		st.removeHistory(ctx, records)
+		if !conditioned || !isConcurrentChange(err) || attempt >= st.conflictRetries() {
+			return err
+		}
+	}
+}
+
+// guardWrite conditions the write on the recorded document: on its sequence
+// number when it existed, or on creating it when it did not. Writes with a
+// condition of their own are left as is, as are externally versioned ones
+// which Elastic Search does not let combine with a sequence number
+func guardWrite(opts *WriteOptions, previous *Document) bool {
+	if opts.IfSeqNo != nil || opts.OpType != "" || opts.isExternallyVersioned() {
+		return false
+	}
+	if !previous.Found {
+		opts.OpType = "create"
+		return true
+	}
+	seqNo, primaryTerm := previous.SeqNo, previous.PrimaryTerm
+	opts.IfSeqNo = &seqNo
+	opts.IfPrimaryTerm = &primaryTerm
+	opts.RetryOnConflict = nil
+	return true
+}
+
+func isConcurrentChange(err error) bool {
+	return errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrAlreadyExists)
+}
+
+// bulkWithHistory writes the bulk items one at a time through withHistory,
+// because the bulk API cannot condition an item on its sequence number. The
+// result is reported the same way Bulk does
+func (st *ElasticJsonDataStore[T]) bulkWithHistory(ctx context.Context, operation string, items []*BulkItem) *BulkResult {
+	refresh := st.bulkOptions(ctx).Refresh
+
+	rtn := &BulkResult{}
+	rtn.Stats.NumRequests = uint64(len(items))
+	for _, item := range items {
+		rtn.Stats.NumAdded++
+
+		opts := &WriteOptions{
+			Refresh:     refresh,
+			Routing:     item.Routing,
+			Version:     item.Version,
+			VersionType: item.VersionType,
+		}
+		if item.Action == BulkActionCreate {
+			opts.OpType = "create"
+		}
+		err := st.withHistory(ctx, operation, item.ID, opts, func(opts *WriteOptions) error {
+			return writeBulkItem(ctx, st.Client, st.Index, item, opts)
+		})
+		if err != nil {
+			rtn.Stats.NumFailed++
+			itemErr := &BulkItemError{ID: item.ID, Action: item.Action, Reason: err.Error()}
+			var elasticErr *ElasticError
+			if errors.As(err, &elasticErr) {
+				itemErr.Status = elasticErr.Status
+				itemErr.Type = elasticErr.Type
+				itemErr.Reason = elasticErr.Reason
+			}
+			if errors.Is(err, ErrStaleVersion) {
+				itemErr.Stale = true
+				rtn.StaleItems = append(rtn.StaleItems, itemErr)
+			} else {
+				rtn.Errors = append(rtn.Errors, itemErr)
+			}
+			continue
+		}
+
+		rtn.Stats.NumFlushed++
+		switch item.Action {
+		case BulkActionIndex:
+			rtn.Stats.NumIndexed++
+		case BulkActionCreate:
+			rtn.Stats.NumCreated++
+		case BulkActionUpdate:
+			rtn.Stats.NumUpdated++
+		case BulkActionDelete:
+			rtn.Stats.NumDeleted++
+		}
+	}
+	return rtn
+}
+
+// writeBulkItem writes a single bulk item with the document APIs
+func writeBulkItem(ctx context.Context, client *elasticsearch.Client, index string, item *BulkItem, opts *WriteOptions) error {
+	var err error
+	switch item.Action {
+	case BulkActionIndex, BulkActionCreate:
+		_, err = IndexDataWithOptions(ctx, client, item.Data, item.ID, index, opts)
+	case BulkActionUpdate:
+		body := &UpdateBody{}
+		if err = json.Unmarshal(item.Data, body); err == nil {
+			_, err = UpdateData(ctx, client, body, item.ID, index, opts)
+		}
+	case BulkActionDelete:
+		_, err = RemoveDataWithOptions(ctx, client, item.ID, index, opts)
+	default:
+		err = fmt.Errorf("unsupported bulk action %v", item.Action)
+	}
+	return err
+}
+
+// recordHistory writes the previous documents to the history index and
+// returns the IDs of the records. If any of them fails the others are
+// removed again, so the history is written entirely or not at all
+func (st *ElasticJsonDataStore[T]) recordHistory(ctx context.Context, operation string, previous []*Document) ([]string, error) {
+	if !st.History || len(previous) == 0 {
+		return nil, nil
+	}
+
+	user := cloudy.GetUser(ctx).UPN
+	now := time.Now().UTC()
+
+	items := make([]*BulkItem, len(previous))
+	for i, doc := range previous {
+		record := &historyRecord{
+			Key:       doc.ID,
+			Operation: operation,
+			User:      user,
+			Timestamp: now,
+			Existed:   doc.Found,
+		}
+		if doc.Found {
+			record.Version = doc.Version
+			record.Document = doc.Source
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = &BulkItem{Action: BulkActionIndex, ID: UUIDGenerator(), Data: data}
+	}
+
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+
+	result, err := Bulk(ctx, st.Client, st.historyIndex(), items, st.bulkOptions(ctx))
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		// The items without an error may have been written
+		st.removeHistory(ctx, ids)
+		return nil, fmt.Errorf("error recording history: %w", err)
+	}
+	return ids, nil
+}
+
+// removeHistory removes the records of a write that did not happen. It is
+// best effort, a failure is only logged
+func (st *ElasticJsonDataStore[T]) removeHistory(ctx context.Context, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	items := make([]*BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = &BulkItem{Action: BulkActionDelete, ID: id}
+	}
+	result, err := Bulk(ctx, st.Client, st.historyIndex(), items, st.bulkOptions(ctx))
+	if err != nil {
+		cloudy.Warn(ctx, "Error removing history records of a failed write to %v: %v", st.Index, err)
+		return
+	}
+	for _, itemErr := range result.Errors {
+		if itemErr.Status != 404 {
+			cloudy.Warn(ctx, "Error removing history record of a failed write to %v: %v", st.Index, itemErr)
+		}
+	}
+}
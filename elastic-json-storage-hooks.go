@@ -0,0 +1,135 @@
+package cloudyelastic
+
+import (
+	"context"
+)
+
+// BeforeSaver is implemented by models that need to be prepared before they
+// are written, e.g. to stamp audit fields or compute derived fields.
+// Returning an error aborts the write
+type BeforeSaver interface {
+	BeforeSave(ctx context.Context) error
+}
+
+// AfterSaver is implemented by models that need to act once they were written
+type AfterSaver interface {
+	AfterSave(ctx context.Context) error
+}
+
+// BeforeDeleter is implemented by models that need to act before they are
+// deleted. The stored item is loaded to call it, items that do not exist
+// are skipped. Returning an error aborts the delete
+type BeforeDeleter interface {
+	BeforeDelete(ctx context.Context) error
+}
+
+// AfterLoader is implemented by models that need to be post-processed after
+// they are read. Returning an error fails the read
+type AfterLoader interface {
+	AfterLoad(ctx context.Context) error
+}
+
+// Hooks are functions called by the store around its operations, in
+// addition to the hook interfaces implemented by the model. The store
+// hooks run after the model ones. BeforeSave and BeforeDelete abort the
+// operation when they return an error.
+//
+// Partial updates (Patch, Upsert and the script of UpdateWithScript) and
+// the by query operations do not go through the hooks
+type Hooks[T any] struct {
+	BeforeSave   func(ctx context.Context, key string, item *T) error
+	AfterSave    func(ctx context.Context, key string, item *T) error
+	AfterLoad    func(ctx context.Context, item *T) error
+	BeforeDelete func(ctx context.Context, key string) error
+}
+
+func (st *ElasticJsonDataStore[T]) beforeSave(ctx context.Context, key string, item *T) error {
+	if item == nil {
+		return nil
+	}
+	if hook, ok := interface{}(item).(BeforeSaver); ok {
+		if err := hook.BeforeSave(ctx); err != nil {
+			return err
+		}
+	}
+	if st.Hooks.BeforeSave != nil {
+		return st.Hooks.BeforeSave(ctx, key, item)
+	}
+	return nil
+}
+
+func (st *ElasticJsonDataStore[T]) afterSave(ctx context.Context, key string, item *T) error {
+	if item == nil {
+		return nil
+	}
+	if hook, ok := interface{}(item).(AfterSaver); ok {
+		if err := hook.AfterSave(ctx); err != nil {
+			return err
+		}
+	}
+	if st.Hooks.AfterSave != nil {
+		return st.Hooks.AfterSave(ctx, key, item)
+	}
+	return nil
+}
+
+// afterSaveMany copies the prepared items back into the items that were
+// written and calls their after save hooks
+func (st *ElasticJsonDataStore[T]) afterSaveMany(ctx context.Context, items []*T, prepared []*T, keys []string, result *BulkResult) error {
+	failed := result.skipped()
+	for i, item := range items {
+		if failed[keys[i]] {
+			continue
+		}
+		commitItem(item, prepared[i])
+		if err := st.afterSave(ctx, keys[i], item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *ElasticJsonDataStore[T]) afterLoad(ctx context.Context, item *T) error {
+	if item == nil {
+		return nil
+	}
+	if hook, ok := interface{}(item).(AfterLoader); ok {
+		if err := hook.AfterLoad(ctx); err != nil {
+			return err
+		}
+	}
+	if st.Hooks.AfterLoad != nil {
+		return st.Hooks.AfterLoad(ctx, item)
+	}
+	return nil
+}
+
+func (st *ElasticJsonDataStore[T]) beforeDelete(ctx context.Context, keys ...string) error {
+	if _, ok := interface{}(new(T)).(BeforeDeleter); ok {
+		items, err := st.GetMany(ctx, keys)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item.Err != nil {
+				return item.Err
+			}
+			if !item.Found {
+				continue
+			}
+			if err := interface{}(item.Item).(BeforeDeleter).BeforeDelete(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if st.Hooks.BeforeDelete == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := st.Hooks.BeforeDelete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
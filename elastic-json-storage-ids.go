@@ -0,0 +1,285 @@
+package cloudyelastic
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+)
+
+const (
+	// Tag of the string field that receives the key assigned by Add
+	tagID = "id"
+	// Tag of the time field set when an item is first saved
+	tagCreatedAt = "createdAt"
+	// Tag of the time field set every time an item is saved
+	tagUpdatedAt = "updatedAt"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// UUIDGenerator generates random (version 4) UUIDs
+func UUIDGenerator() string {
+	return uuid.NewString()
+}
+
+// ULIDGenerator generates ULIDs, which sort by creation time
+func ULIDGenerator() string {
+	return ulid.MustNew(ulid.Now(), rand.Reader).String()
+}
+
+// Add saves a new item and returns its key. The key is created by the
+// IDGenerator of the store, or assigned by Elastic Search when there is
+// none. The string field tagged `elastic:"id"`, if any, is set to the key,
+// which with Elastic Search assigned keys takes a second write
+func (st *ElasticJsonDataStore[T]) Add(ctx context.Context, item *T) (string, error) {
+	prepared := copyItem(item)
+	var key string
+	if st.IDGenerator != nil {
+		key = st.IDGenerator()
+		if err := setIDField(prepared, key); err != nil {
+			return "", err
+		}
+	}
+
+	data, err := st.marshal(ctx, key, prepared)
+	if err != nil {
+		return "", err
+	}
+	opts := st.writeOptions(ctx, key, prepared)
+	opts.Version = nil
+	opts.VersionType = ""
+	opts.OpType = "create"
+	if key != "" {
+		err = st.withHistory(ctx, HistoryOperationSave, key, opts, func(opts *WriteOptions) error {
+			_, err := CreateData(ctx, st.Client, data, key, st.Index, opts)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		commitItem(item, prepared)
+		return key, st.afterSave(ctx, key, item)
+	}
+
+	// Keys assigned by Elastic Search are new, so there is no history
+	result, err := CreateData(ctx, st.Client, data, key, st.Index, opts)
+	if err != nil {
+		return "", err
+	}
+	key = result.ID
+	if err := st.storeIDField(ctx, prepared, result, opts); err != nil {
+		return "", err
+	}
+	commitItem(item, prepared)
+	return key, st.afterSave(ctx, key, item)
+}
+
+// storeIDField sets the id field of the item to the key Elastic Search
+// assigned and writes it into the stored document. When that fails the
+// document is removed again, so that Add either fully succeeds or fails
+func (st *ElasticJsonDataStore[T]) storeIDField(ctx context.Context, item *T, result *WriteResult, opts *WriteOptions) error {
+	partial := make(map[string]interface{})
+	for _, field := range taggedFieldsWith(reflect.TypeOf(item).Elem(), tagID) {
+		if field.Index == nil {
+			continue
+		}
+		parent := partial
+		for _, name := range field.Path[:len(field.Path)-1] {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+		parent[field.Path[len(field.Path)-1]] = result.ID
+	}
+	if len(partial) == 0 {
+		return nil
+	}
+	if err := setIDField(item, result.ID); err != nil {
+		return st.removeAdded(ctx, result, opts, err)
+	}
+
+	patchOpts := *opts
+	patchOpts.IfSeqNo = &result.SeqNo
+	patchOpts.IfPrimaryTerm = &result.PrimaryTerm
+	_, err := PatchData(ctx, st.Client, partial, result.ID, st.Index, false, &patchOpts)
+	if err != nil {
+		return st.removeAdded(ctx, result, opts, fmt.Errorf("error storing the key in the id field: %w", err))
+	}
+	return nil
+}
+
+// removeAdded removes a document Add could not complete and returns the
+// error that caused it
+func (st *ElasticJsonDataStore[T]) removeAdded(ctx context.Context, result *WriteResult, opts *WriteOptions, cause error) error {
+	removeOpts := *opts
+	removeOpts.OpType = ""
+	if _, err := RemoveDataWithOptions(ctx, st.Client, result.ID, st.Index, &removeOpts); err != nil {
+		cloudy.Warn(ctx, "Error removing incomplete document %v from %v: %v", result.ID, st.Index, err)
+	}
+	return cause
+}
+
+// copyItem returns a deep copy of the item for a write to prepare, so that
+// a failed write leaves the item as it was. Exported fields are copied
+// through pointers, slices, maps and interfaces, unexported fields are
+// copied as they are. See commitItem
+func copyItem[T any](item *T) *T {
+	if item == nil {
+		return nil
+	}
+	rtn := new(T)
+	copyValue(reflect.ValueOf(rtn).Elem(), reflect.ValueOf(item).Elem(), make(map[copiedPointer]reflect.Value))
+	return rtn
+}
+
+// copiedPointer identifies a pointer already copied by copyValue
+type copiedPointer struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// copyValue deep copies src into dst. Every pointer is copied once, so that
+// shared pointers and cycles are kept in the copy
+func copyValue(dst reflect.Value, src reflect.Value, seen map[copiedPointer]reflect.Value) {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		key := copiedPointer{src.Pointer(), src.Type()}
+		if copied, ok := seen[key]; ok {
+			dst.Set(copied)
+			return
+		}
+		copied := reflect.New(src.Type().Elem())
+		seen[key] = copied
+		copyValue(copied.Elem(), src.Elem(), seen)
+		dst.Set(copied)
+	case reflect.Struct:
+		dst.Set(src)
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				copyValue(dst.Field(i), src.Field(i), seen)
+			}
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		copied := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		for i := 0; i < src.Len(); i++ {
+			copyValue(copied.Index(i), src.Index(i), seen)
+		}
+		dst.Set(copied)
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			copyValue(dst.Index(i), src.Index(i), seen)
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		copied := reflect.MakeMapWithSize(src.Type(), src.Len())
+		iter := src.MapRange()
+		for iter.Next() {
+			value := reflect.New(src.Type().Elem()).Elem()
+			copyValue(value, iter.Value(), seen)
+			copied.SetMapIndex(iter.Key(), value)
+		}
+		dst.Set(copied)
+	case reflect.Interface:
+		if src.IsNil() {
+			dst.Set(src)
+			return
+		}
+		value := reflect.New(src.Elem().Type()).Elem()
+		copyValue(value, src.Elem(), seen)
+		dst.Set(value)
+	default:
+		dst.Set(src)
+	}
+}
+
+// commitItem copies the prepared item back once the write succeeded
+func commitItem[T any](item *T, prepared *T) {
+	if item != nil && prepared != nil {
+		*item = *prepared
+	}
+}
+
+// setIDField sets the field tagged `elastic:"id"` to the key
+func setIDField[T any](item *T, key string) error {
+	fields := taggedFieldsWith(reflect.TypeOf(item).Elem(), tagID)
+	for _, field := range fields {
+		value, ok := settableField(item, field)
+		if !ok {
+			continue
+		}
+		if value.Kind() != reflect.String {
+			return fmt.Errorf("id field %v must be a string", field.Name())
+		}
+		value.SetString(key)
+	}
+	return nil
+}
+
+// stampTimes maintains the fields tagged `elastic:"createdAt"` and
+// `elastic:"updatedAt"`. The created time is only set when it is empty, so
+// items that are loaded and saved back keep it
+func stampTimes[T any](item *T, now time.Time) error {
+	t := reflect.TypeOf(item).Elem()
+	for _, field := range taggedFieldsWith(t, tagCreatedAt) {
+		if err := setTime(item, field, now, false); err != nil {
+			return err
+		}
+	}
+	for _, field := range taggedFieldsWith(t, tagUpdatedAt) {
+		if err := setTime(item, field, now, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setTime[T any](item *T, field *taggedField, now time.Time, overwrite bool) error {
+	value, ok := settableField(item, field)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case value.Type() == timeType:
+		if overwrite || value.Interface().(time.Time).IsZero() {
+			value.Set(reflect.ValueOf(now))
+		}
+	case value.Type() == reflect.PtrTo(timeType):
+		if overwrite || value.IsNil() || value.Interface().(*time.Time).IsZero() {
+			value.Set(reflect.ValueOf(&now))
+		}
+	default:
+		return fmt.Errorf("timestamp field %v must be a time.Time", field.Name())
+	}
+	return nil
+}
+
+// settableField returns the field of the item. Fields of nil nested structs
+// are skipped
+func settableField[T any](item *T, field *taggedField) (reflect.Value, bool) {
+	if field.Index == nil {
+		return reflect.Value{}, false
+	}
+	value, err := reflect.ValueOf(item).Elem().FieldByIndexErr(field.Index)
+	return value, err == nil
+}
@@ -0,0 +1,74 @@
+package cloudyelastic
+
+import (
+	"context"
+	"time"
+)
+
+// Restore undoes the soft delete of the item
+func (st *ElasticJsonDataStore[T]) Restore(ctx context.Context, key string) error {
+	return st.withHistory(ctx, HistoryOperationRestore, key, st.writeOptions(ctx, key, nil), func(opts *WriteOptions) error {
+		_, err := PatchData(ctx, st.Client, st.deletedMarker(false), key, st.Index, false, opts)
+		return err
+	})
+}
+
+// ListDeleted returns all the soft deleted items, paging through the index
+// with a cursor
+func (st *ElasticJsonDataStore[T]) ListDeleted(ctx context.Context) ([]*T, error) {
+	query := NewQuery()
+	query.Query.Bool.Filter.Terms(st.deletedField(), "true")
+
+	opts := &CursorOptions{
+		Routing: st.searchOptions(ctx).Routing,
+	}
+	cursor, err := openCursor(ctx, st.Client, st.Index, query.BuildContainer(), opts, func(data []byte) (*SearchResponse[T], error) {
+		return st.decodeSearch(ctx, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readAll(cursor)
+}
+
+// Purge permanently removes the items that were soft deleted more than
+// olderThan ago
+func (st *ElasticJsonDataStore[T]) Purge(ctx context.Context, olderThan time.Duration) (*ByQueryResponse, error) {
+	cutoff := time.Now().Add(-olderThan).UTC().Format(time.RFC3339Nano)
+
+	query := NewQuery()
+	query.Query.Bool.Filter.Terms(st.deletedField(), "true")
+	query.Query.Bool.Filter.Range(st.deletedAtField(), "", cutoff)
+
+	return st.DeleteByQuery(ctx, query, &ByQueryOptions{
+		ProceedOnConflicts: true,
+		Refresh:            true,
+	})
+}
+
+// deletedMarker is the partial document that marks an item as deleted or
+// restores it
+func (st *ElasticJsonDataStore[T]) deletedMarker(deleted bool) map[string]interface{} {
+	var deletedAt interface{}
+	if deleted {
+		deletedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	return map[string]interface{}{
+		st.deletedField():   deleted,
+		st.deletedAtField(): deletedAt,
+	}
+}
+
+func (st *ElasticJsonDataStore[T]) deletedField() string {
+	if st.DeletedField == "" {
+		return "_deleted"
+	}
+	return st.DeletedField
+}
+
+func (st *ElasticJsonDataStore[T]) deletedAtField() string {
+	if st.DeletedAtField == "" {
+		return "_deletedAt"
+	}
+	return st.DeletedAtField
+}
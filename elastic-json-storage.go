@@ -3,9 +3,13 @@ package cloudyelastic
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Jeffail/gabs/v2"
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/datastore"
 
@@ -16,6 +20,104 @@ type ElasticJsonDataStore[T any] struct {
 	Client *elasticsearch.Client
 	Index  string
 	Model  interface{}
+	Bulk   *BulkOptions
+
+	// Refresh policy of all the writes. Defaults to RefreshImmediate and can be
+	// overridden per call with WithRefresh or WithWriteOptions
+	Refresh RefreshPolicy
+
+	// Number of times Mutate retries after a version conflict. Defaults to 3
+	ConflictRetries int
+
+	// Derives the routing of a document from its key. It is used by every
+	// read, write and delete, WithRouting overrides it per call
+	RoutingFunc func(key string) string
+	// Derives the routing of a document from the item. It is only used by
+	// the writes of whole items (Save, Create, SaveIfMatch, Mutate, SaveMany,
+	// CreateMany, Add and the UpdateWithScript upsert) and wins over
+	// RoutingFunc there. Reads, deletes and partial updates have no item, so
+	// they must be given the routing with WithRouting to reach the shard
+	ItemRoutingFunc func(item *T) string
+
+	// Derives the external version of an item, for documents synced from
+	// another source of truth. When set, saving an older version than the
+	// stored one returns ErrStaleVersion instead of overwriting it
+	VersionFunc func(item *T) int64
+	// Either VersionTypeExternal (default) or VersionTypeExternalGTE
+	VersionType string
+
+	// Delete only marks items as deleted. Deleted items are hidden from all
+	// reads until they are restored (or saved again) and can be purged later
+	SoftDelete bool
+	// Names of the soft delete fields. Default to "_deleted" and "_deletedAt"
+	DeletedField   string
+	DeletedAtField string
+
+	// Keep the previous version of an item in a history index on every
+	// write. The version is recorded before the write, which is conditioned
+	// on it and retried up to ConflictRetries times, so concurrent writes
+	// are all recorded. Bulk writes are then sent one document at a time.
+	// Not recorded are the by query operations (DeleteByQuery,
+	// UpdateByQuery, Purge and the expiry reaper) and Add with keys assigned
+	// by Elastic Search. Externally versioned writes cannot be conditioned,
+	// so concurrent ones may be missed. The history index defaults to the
+	// index name + "-history"
+	History      bool
+	HistoryIndex string
+
+	// Expire items after a while. Expired items are hidden from all reads
+	// and removed by the reaper. TTL is the default time to live of saved
+	// items, which can be overridden per call with WithTTL or SaveWithTTL.
+	// Saving without a TTL keeps the expiry of the stored item, which costs
+	// a multi get of the expiry field before every whole-item write and
+	// bulk. Setting a TTL avoids that round trip and enables expiry
+	Expires bool
+	TTL     time.Duration
+	// Name of the expiry field. Defaults to "_expiresAt"
+	ExpiresAtField string
+
+	// Encrypts the string fields tagged `elastic:"encrypt"` on save and
+	// decrypts them on load. Fields tagged `elastic:"encrypt,searchable"`
+	// always encrypt to the same value and can be matched with EncryptedValue.
+	// Partial updates (Patch, Upsert, UpdateWithScript and UpdateByQuery)
+	// store their values as provided, encrypt them with EncryptedValue
+	Encryption FieldEncryptor
+
+	// Checks the items before they are written, in addition to the Validate
+	// method of the items that implement Validator. The schema is checked
+	// against the item as JSON, the size against the stored document
+	Validation *DocumentValidation
+
+	// Functions called around the operations of the store, see Hooks
+	Hooks Hooks[T]
+
+	// Generates the keys of the items saved with Add, e.g. UUIDGenerator or
+	// ULIDGenerator. When nil Elastic Search assigns the keys
+	IDGenerator func() string
+
+	// Mapping of the index, loaded to sort text fields on their keyword
+	// sub-field
+	mapping sortMapping
+}
+
+// Versioned is an item along with the information needed to conditionally
+// save it back with SaveIfMatch
+type Versioned[T any] struct {
+	Key         string
+	Item        *T
+	Version     int64
+	SeqNo       int
+	PrimaryTerm int
+}
+
+// MultiGetItem is a single result of GetMany. Found is false, and Item
+// nil, when there is no item for the key. Err is set when the item alone
+// could not be loaded or decoded
+type MultiGetItem[T any] struct {
+	Key   string
+	Item  *T
+	Found bool
+	Err   error
 }
 
 func NewElasticJsonDataStore[T any](index string) *ElasticJsonDataStore[T] {
@@ -61,21 +163,22 @@ func (st *ElasticJsonDataStore[T]) Open(ctx context.Context, config interface{})
 		return err
 	}
 
-	if resp.StatusCode == 200 {
-		return nil
-	}
+	if resp.StatusCode != 200 {
+		// Create the index
+		createResp, err := client.Indices.Create(st.Index)
+		if err != nil {
+			return err
+		}
 
-	// Create the index
-	createResp, err := client.Indices.Create(st.Index)
-	if err != nil {
-		return err
+		defer createResp.Body.Close()
+		if createResp.IsError() {
+			return responseError(createResp, st.Index, "")
+		}
 	}
 
-	if createResp.StatusCode > 201 {
-		data, _ := ioutil.ReadAll(createResp.Body)
-		return fmt.Errorf("error creating index %v, %v", st.Index, string(data))
+	if st.History {
+		return st.openHistory(ctx)
 	}
-
 	return nil
 }
 
@@ -88,75 +191,943 @@ func (st *ElasticJsonDataStore[T]) Close(ctx context.Context) error {
 // The key is used as the ID for the document and is required to be unique
 // for this index
 func (st *ElasticJsonDataStore[T]) Save(ctx context.Context, item *T, key string) error {
-	data, err := json.Marshal(item)
+	prepared := copyItem(item)
+	data, err := st.marshal(ctx, key, prepared)
 	if err != nil {
 		return err
 	}
-	return IndexData(st.Client, data, key, st.Index)
+	err = st.withHistory(ctx, HistoryOperationSave, key, st.writeOptions(ctx, key, prepared), func(opts *WriteOptions) error {
+		_, err := IndexDataWithOptions(ctx, st.Client, data, key, st.Index, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	commitItem(item, prepared)
+	return st.afterSave(ctx, key, item)
 }
 
+// Create saves the item only if there is no item with the same key yet.
+// Otherwise ErrAlreadyExists is returned
+func (st *ElasticJsonDataStore[T]) Create(ctx context.Context, item *T, key string) error {
+	prepared := copyItem(item)
+	data, err := st.marshal(ctx, key, prepared)
+	if err != nil {
+		return err
+	}
+	opts := st.writeOptions(ctx, key, prepared)
+	opts.Version = nil
+	opts.VersionType = ""
+	opts.OpType = "create"
+	err = st.withHistory(ctx, HistoryOperationSave, key, opts, func(opts *WriteOptions) error {
+		_, err := CreateData(ctx, st.Client, data, key, st.Index, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	commitItem(item, prepared)
+	return st.afterSave(ctx, key, item)
+}
+
+// SaveIfMatch saves the item only if the stored document still has the given
+// sequence number and primary term. If the document was changed in the
+// meantime ErrVersionConflict is returned.
+func (st *ElasticJsonDataStore[T]) SaveIfMatch(ctx context.Context, item *T, key string, seqNo int, primaryTerm int) error {
+	prepared := copyItem(item)
+	data, err := st.marshal(ctx, key, prepared)
+	if err != nil {
+		return err
+	}
+	opts := st.writeOptions(ctx, key, prepared)
+	opts.Version = nil
+	opts.VersionType = ""
+	opts.IfSeqNo = &seqNo
+	opts.IfPrimaryTerm = &primaryTerm
+	err = st.withHistory(ctx, HistoryOperationSave, key, opts, func(opts *WriteOptions) error {
+		_, err := IndexDataWithOptions(ctx, st.Client, data, key, st.Index, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	commitItem(item, prepared)
+	return st.afterSave(ctx, key, item)
+}
+
+// Mutate loads the item, applies the mutation and saves it back
+// conditionally. When another writer changed the document in between, the
+// item is re-read and the mutation applied again, up to ConflictRetries times.
+func (st *ElasticJsonDataStore[T]) Mutate(ctx context.Context, key string, mutate func(item *T) error) (*T, error) {
+	retries := st.conflictRetries()
+	for attempt := 0; ; attempt++ {
+		current, err := st.GetVersioned(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		err = mutate(current.Item)
+		if err != nil {
+			return nil, err
+		}
+
+		err = st.SaveIfMatch(ctx, current.Item, key, current.SeqNo, current.PrimaryTerm)
+		if err == nil {
+			return current.Item, nil
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt >= retries {
+			return nil, err
+		}
+	}
+}
+
+// Patch merges the partial item (any JSON marshalable value, typically a map
+// or a struct with omitempty fields) into the stored document
+func (st *ElasticJsonDataStore[T]) Patch(ctx context.Context, key string, partial interface{}) error {
+	return st.withHistory(ctx, HistoryOperationUpdate, key, st.writeOptions(ctx, key, nil), func(opts *WriteOptions) error {
+		_, err := PatchData(ctx, st.Client, partial, key, st.Index, false, opts)
+		return err
+	})
+}
+
+// Upsert merges the partial item into the stored document, or creates the
+// document from the partial item if it does not exist
+func (st *ElasticJsonDataStore[T]) Upsert(ctx context.Context, key string, partial interface{}) error {
+	return st.withHistory(ctx, HistoryOperationUpdate, key, st.writeOptions(ctx, key, nil), func(opts *WriteOptions) error {
+		if opts.OpType == "create" {
+			// Known not to exist, which an update cannot be conditioned on
+			data, err := json.Marshal(partial)
+			if err != nil {
+				return err
+			}
+			_, err = CreateData(ctx, st.Client, data, key, st.Index, opts)
+			return err
+		}
+		_, err := PatchData(ctx, st.Client, partial, key, st.Index, true, opts)
+		return err
+	})
+}
+
+// UpdateWithScript runs the script against the stored document. If upsert is
+// not nil it is saved when the document does not exist yet. The upsert is
+// validated and encrypted like a saved item, the after save hooks only run
+// when it was saved
+func (st *ElasticJsonDataStore[T]) UpdateWithScript(ctx context.Context, key string, script *Script, upsert *T) error {
+	var upsertDoc interface{}
+	var data []byte
+	prepared := copyItem(upsert)
+	if upsert != nil {
+		marshaled, err := st.marshal(ctx, key, prepared)
+		if err != nil {
+			return err
+		}
+		data = marshaled
+		upsertDoc = json.RawMessage(data)
+	}
+
+	created := false
+	err := st.withHistory(ctx, HistoryOperationUpdate, key, st.writeOptions(ctx, key, prepared), func(opts *WriteOptions) error {
+		var result *WriteResult
+		var err error
+		if opts.OpType == "create" && upsert != nil {
+			// Known not to exist, which an update cannot be conditioned on
+			result, err = CreateData(ctx, st.Client, data, key, st.Index, opts)
+		} else {
+			result, err = ScriptUpdateData(ctx, st.Client, script, upsertDoc, key, st.Index, opts)
+		}
+		if err != nil {
+			return err
+		}
+		created = result.Result == "created"
+		return nil
+	})
+	if err != nil || !created {
+		return err
+	}
+	commitItem(upsert, prepared)
+	return st.afterSave(ctx, key, upsert)
+}
+
+// SaveMany saves all the items using the bulk API. The keys are matched to
+// the items by position. Failed items are reported in the result.
+func (st *ElasticJsonDataStore[T]) SaveMany(ctx context.Context, items []*T, keys []string) (*BulkResult, error) {
+	bulkItems, prepared, err := st.bulkItems(ctx, BulkActionIndex, items, keys)
+	if err != nil {
+		return nil, err
+	}
+	result, err := st.bulk(ctx, HistoryOperationSave, bulkItems)
+	if err != nil {
+		return result, err
+	}
+	return result, st.afterSaveMany(ctx, items, prepared, keys, result)
+}
+
+// Get retrieves an item by its key using the real-time GET API. As for any
+// datastore.JsonDataStore, nil and no error are returned when the item does
+// not exist. Use MustGet to get ErrNotFound instead
 func (st *ElasticJsonDataStore[T]) Get(ctx context.Context, key string) (*T, error) {
-	data, err := LoadByID(st.Client, key, st.Index)
+	item, err := st.GetWithOptions(ctx, key, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return item, err
+}
+
+// MustGet retrieves an item by its key. ErrNotFound is returned when the
+// item does not exist
+func (st *ElasticJsonDataStore[T]) MustGet(ctx context.Context, key string) (*T, error) {
+	return st.GetWithOptions(ctx, key, nil)
+}
+
+// GetWithOptions retrieves an item by its key, only loading the source
+// fields allowed by the options. ErrNotFound is returned when the item does
+// not exist
+func (st *ElasticJsonDataStore[T]) GetWithOptions(ctx context.Context, key string, opts *GetOptions) (*T, error) {
+	data, err := LoadByIDWithOptions(ctx, st.Client, key, st.Index, st.getOptions(ctx, key, opts))
 	if err != nil {
 		return nil, err
 	}
 
-	model, err := cloudy.UnmarshallT[T](data)
+	visible, err := st.visible(data)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, fmt.Errorf("%w: document ID=%v", ErrNotFound, key)
+	}
+
+	model, err := st.unmarshal(ctx, data)
 
 	return model, err
 }
 
-func (st *ElasticJsonDataStore[T]) GetAll(ctx context.Context) ([]*T, error) {
+// GetMany retrieves all the items in a single request. The results are in
+// the same order as the keys. An item that fails on its own is reported in
+// its Err, the error is only returned when the whole request failed
+func (st *ElasticJsonDataStore[T]) GetMany(ctx context.Context, keys []string) ([]*MultiGetItem[T], error) {
+	routings := make([]string, len(keys))
+	for i, key := range keys {
+		routings[i] = st.routing(ctx, key, nil)
+	}
+	docs, err := MultiLoadByIDRouted(ctx, st.Client, keys, routings, st.Index, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rtn := make([]*MultiGetItem[T], len(keys))
+	for i, key := range keys {
+		rtn[i] = &MultiGetItem[T]{Key: key}
+		if i >= len(docs) {
+			continue
+		}
+		if docs[i].Error != nil {
+			rtn[i].Err = docs[i].Error
+			continue
+		}
+		if !docs[i].Found {
+			continue
+		}
+		visible, err := st.visible(docs[i].Source)
+		if err != nil {
+			rtn[i].Err = err
+			continue
+		}
+		if !visible {
+			continue
+		}
+		model, err := st.unmarshal(ctx, docs[i].Source)
+		if err != nil {
+			rtn[i].Err = err
+			continue
+		}
+		rtn[i].Item = model
+		rtn[i].Found = true
+	}
 
-	query := NewQuery()
-	query.Size = 10000
-	query.Query.MatchAll = true
+	return rtn, nil
+}
 
-	results, err := Query(st.Client, st.Index, query.Build())
+// GetVersioned retrieves an item along with its version information.
+// ErrNotFound is returned when the item does not exist
+func (st *ElasticJsonDataStore[T]) GetVersioned(ctx context.Context, key string) (*Versioned[T], error) {
+	doc, err := GetDocument(ctx, st.Client, key, st.Index, st.getOptions(ctx, key, nil))
 	if err != nil {
 		return nil, err
 	}
 
-	items, err := ParseResultsTyped[T](results)
+	visible, err := st.visible(doc.Source)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, fmt.Errorf("%w: document ID=%v", ErrNotFound, key)
+	}
+
+	model, err := st.unmarshal(ctx, doc.Source)
+	if err != nil {
+		return nil, err
+	}
 
-	return items, err
+	return &Versioned[T]{
+		Key:         key,
+		Item:        model,
+		Version:     doc.Version,
+		SeqNo:       doc.SeqNo,
+		PrimaryTerm: doc.PrimaryTerm,
+	}, nil
+}
+
+// GetAll loads every item, paging through the index with a cursor
+func (st *ElasticJsonDataStore[T]) GetAll(ctx context.Context) ([]*T, error) {
+	cursor, err := st.Iterate(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return readAll(cursor)
 }
 
 func (st *ElasticJsonDataStore[T]) Exists(ctx context.Context, key string) (bool, error) {
-	idQuery := GenerateIDQuery([]string{key})
+	if !st.hasControlFields() {
+		return DocumentExists(ctx, st.Client, key, st.Index, st.getOptions(ctx, key, nil))
+	}
 
-	results, err := Query(st.Client, st.Index, idQuery)
+	// Only load the control fields to check if the item is visible
+	doc, err := GetDocument(ctx, st.Client, key, st.Index, st.getOptions(ctx, key, &GetOptions{
+		SourceIncludes: st.controlFields(),
+	}))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
-	if IsError(results) {
-		return false, ToError(results)
+	return st.visible(doc.Source)
+}
+
+// Delete removes the item. In soft delete mode the item is only marked as
+// deleted
+func (st *ElasticJsonDataStore[T]) Delete(ctx context.Context, key string) error {
+	if err := st.beforeDelete(ctx, key); err != nil {
+		return err
 	}
+	return st.withHistory(ctx, HistoryOperationDelete, key, st.writeOptions(ctx, key, nil), func(opts *WriteOptions) error {
+		var err error
+		if st.SoftDelete {
+			_, err = PatchData(ctx, st.Client, st.deletedMarker(true), key, st.Index, false, opts)
+		} else {
+			_, err = RemoveDataWithOptions(ctx, st.Client, key, st.Index, opts)
+		}
+		return err
+	})
+}
 
-	return Hits(results) > 0, nil
+// CreateMany saves the items whose keys do not exist yet using the bulk API.
+// The keys that already existed are reported by BulkResult.Existing
+func (st *ElasticJsonDataStore[T]) CreateMany(ctx context.Context, items []*T, keys []string) (*BulkResult, error) {
+	bulkItems, prepared, err := st.bulkItems(ctx, BulkActionCreate, items, keys)
+	if err != nil {
+		return nil, err
+	}
+	result, err := st.bulk(ctx, HistoryOperationSave, bulkItems)
+	if err != nil {
+		return result, err
+	}
+	return result, st.afterSaveMany(ctx, items, prepared, keys, result)
 }
 
-func (st *ElasticJsonDataStore[T]) Delete(ctx context.Context, key string) error {
-	return RemoveData(st.Client, key, st.Index)
+// bulkItems marshals the items into bulk items. It also returns the
+// prepared copies of the items, see copyItem
+func (st *ElasticJsonDataStore[T]) bulkItems(ctx context.Context, action string, items []*T, keys []string) ([]*BulkItem, []*T, error) {
+	if len(items) != len(keys) {
+		return nil, nil, fmt.Errorf("mismatched save, %v items and %v keys", len(items), len(keys))
+	}
+	expiry, err := st.currentExpiry(ctx, keys, items)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := writeOptionsFromContext(ctx)
+	if action == BulkActionCreate && opts.Version != nil {
+		return nil, nil, errors.New("create-only writes cannot be externally versioned")
+	}
+	rtn := make([]*BulkItem, len(items))
+	prepared := make([]*T, len(items))
+	for i := range items {
+		item := copyItem(items[i])
+		prepared[i] = item
+		data, err := st.marshalDocument(ctx, keys[i], item, expiry[keys[i]])
+		if err != nil {
+			return nil, nil, err
+		}
+		rtn[i] = &BulkItem{
+			Action:  action,
+			ID:      keys[i],
+			Routing: st.routing(ctx, keys[i], item),
+			Data:    data,
+		}
+		if action == BulkActionIndex && opts.Version != nil {
+			// The version of the context wins, as for single writes
+			rtn[i].Version = opts.Version
+			rtn[i].VersionType = opts.VersionType
+		} else if action == BulkActionIndex && st.VersionFunc != nil {
+			version := st.VersionFunc(item)
+			rtn[i].Version = &version
+			rtn[i].VersionType = st.versionType()
+		}
+	}
+	return rtn, prepared, nil
+}
+
+// DeleteMany deletes all the keys using the bulk API. In soft delete mode
+// the items are only marked as deleted
+func (st *ElasticJsonDataStore[T]) DeleteMany(ctx context.Context, keys []string) (*BulkResult, error) {
+	if err := st.beforeDelete(ctx, keys...); err != nil {
+		return nil, err
+	}
+
+	var marker []byte
+	if st.SoftDelete {
+		data, err := json.Marshal(&UpdateBody{Doc: st.deletedMarker(true)})
+		if err != nil {
+			return nil, err
+		}
+		marker = data
+	}
+
+	bulkItems := make([]*BulkItem, len(keys))
+	for i, key := range keys {
+		bulkItems[i] = &BulkItem{
+			Action:  BulkActionDelete,
+			ID:      key,
+			Routing: st.routing(ctx, key, nil),
+		}
+		if st.SoftDelete {
+			bulkItems[i].Action = BulkActionUpdate
+			bulkItems[i].Data = marker
+		}
+	}
+	return st.bulk(ctx, HistoryOperationDelete, bulkItems)
 }
 
+// DeleteByQuery deletes all the items matching the query, which can be an
+// *ElasticSearchQueryBuilder or a *datastore.SimpleQuery
+func (st *ElasticJsonDataStore[T]) DeleteByQuery(ctx context.Context, query interface{}, opts *ByQueryOptions) (*ByQueryResponse, error) {
+	return DeleteByQuery(ctx, st.Client, st.Index, query, st.byQueryOptions(ctx, opts))
+}
+
+// UpdateByQuery runs the script against all the items matching the query,
+// which can be an *ElasticSearchQueryBuilder or a *datastore.SimpleQuery
+func (st *ElasticJsonDataStore[T]) UpdateByQuery(ctx context.Context, query interface{}, script *Script, opts *ByQueryOptions) (*ByQueryResponse, error) {
+	return UpdateByQuery(ctx, st.Client, st.Index, query, script, st.byQueryOptions(ctx, opts))
+}
+
+// Query returns the items matching the conditions of the query, in the
+// order of its sort. Text fields are sorted on their keyword sub-field.
+// ErrUnsupportedCondition is returned for the conditions that cannot be
+// converted
 func (st *ElasticJsonDataStore[T]) Query(ctx context.Context, query *datastore.SimpleQuery) ([]*T, error) {
-	esQuery := new(ElasticQueryConverter).Convert(query)
-	results, err := Query(st.Client, st.Index, esQuery)
+	esQuery, err := st.convert(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	st.applyFilters(esQuery)
+	results, err := QueryWithOptions(ctx, st.Client, st.Index, esQuery.Build(), st.searchOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return st.parseResults(ctx, results)
+}
+
+// Count returns the number of items matching the query, or all the items
+// when the query is nil, without loading them. Deleted and expired items
+// are not counted
+func (st *ElasticJsonDataStore[T]) Count(ctx context.Context, query *datastore.SimpleQuery) (int64, error) {
+	esQuery, err := st.convert(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return CountDocuments(ctx, st.Client, st.Index, st.filteredBody(esQuery).String(), st.searchOptions(ctx))
+}
+
+// Aggregate computes the aggregations over the items matching the query,
+// without loading the items. Deleted and expired items are left out
+func (st *ElasticJsonDataStore[T]) Aggregate(ctx context.Context, query *datastore.SimpleQuery, aggs Aggregations) (AggregationResults, error) {
+	esQuery, err := st.convert(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	esQuery.Size = 0
+	esQuery.Aggregations = aggs
+	res, err := st.Search(ctx, esQuery)
 	if err != nil {
 		return nil, err
 	}
-	return ParseResultsTyped[T](results)
+	return res.AggregationResults()
+}
+
+// Search runs the query and returns the whole response, with the items as
+// the sources of the hits. Deleted and expired items are filtered out
+func (st *ElasticJsonDataStore[T]) Search(ctx context.Context, query *ElasticSearchQueryBuilder) (*SearchResponse[T], error) {
+	results, err := QueryWithOptions(ctx, st.Client, st.Index, st.filteredBody(query).String(), st.searchOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return st.decodeSearch(ctx, []byte(results))
+}
+
+// controlFields are the fields the store adds to documents next to the item
+func (st *ElasticJsonDataStore[T]) controlFields() []string {
+	var rtn []string
+	if st.SoftDelete {
+		rtn = append(rtn, st.deletedField(), st.deletedAtField())
+	}
+	if st.expires() {
+		rtn = append(rtn, st.expiresAtField())
+	}
+	return rtn
+}
+
+func (st *ElasticJsonDataStore[T]) hasControlFields() bool {
+	return len(st.controlFields()) > 0
+}
+
+// visible checks the control fields of a stored document to determine if
+// reads should return it
+func (st *ElasticJsonDataStore[T]) visible(data []byte) (bool, error) {
+	if !st.hasControlFields() || len(data) == 0 {
+		return true, nil
+	}
+
+	parsed, err := gabs.ParseJSON(data)
+	if err != nil {
+		return false, err
+	}
+	if st.SoftDelete {
+		if deleted, ok := parsed.Search(st.deletedField()).Data().(bool); ok && deleted {
+			return false, nil
+		}
+	}
+	if st.expires() {
+		if expiresAt, ok := parsed.Search(st.expiresAtField()).Data().(string); ok {
+			expires, err := time.Parse(time.RFC3339Nano, expiresAt)
+			if err == nil && !expires.After(time.Now()) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// applyFilters restricts the query to the documents reads should return
+func (st *ElasticJsonDataStore[T]) applyFilters(q *ElasticSearchQueryBuilder) {
+	if st.SoftDelete {
+		q.Query.Bool.MustNot.Terms(st.deletedField(), "true")
+	}
+	if st.expires() {
+		q.Query.Bool.MustNot.Range(st.expiresAtField(), "", "now")
+	}
+}
+
+// Iterate opens a cursor over all the items matching the query, or all the
+// items when the query is nil. Deleted and expired items are filtered out.
+// The cursor must be closed unless it is iterated to the end
+func (st *ElasticJsonDataStore[T]) Iterate(ctx context.Context, query *ElasticSearchQueryBuilder) (*Cursor[T], error) {
+	if query == nil {
+		query = NewQuery()
+		query.Query.MatchAll = true
+	}
+	opts := &CursorOptions{
+		Routing: st.searchOptions(ctx).Routing,
+	}
+	return openCursor(ctx, st.Client, st.Index, st.filteredBody(query), opts, func(data []byte) (*SearchResponse[T], error) {
+		return st.decodeSearch(ctx, data)
+	})
+}
+
+// Scroll streams every item matching the query to the callback, along with
+// its key, with low memory use. Deleted and expired items are filtered out.
+// See Scroll for the details
+func (st *ElasticJsonDataStore[T]) Scroll(ctx context.Context, query *datastore.SimpleQuery, opts *ScrollOptions, fn func(key string, item *T) error) error {
+	esQuery, err := st.convert(ctx, query)
+	if err != nil {
+		return err
+	}
+	scrollOpts := opts.withDefaults()
+	if scrollOpts.Routing == "" {
+		scrollOpts.Routing = st.searchOptions(ctx).Routing
+	}
+	decode := func(data []byte) (*SearchResponse[T], error) {
+		return st.decodeSearch(ctx, data)
+	}
+	return scroll(ctx, st.Client, st.Index, st.filteredBody(esQuery), scrollOpts, decode, func(hit *SearchHit[T]) error {
+		return fn(hit.ID, hit.Source)
+	})
+}
+
+// ScrollChannel streams every item matching the query through the returned
+// channel. See ScrollChannel for the details
+func (st *ElasticJsonDataStore[T]) ScrollChannel(ctx context.Context, query *datastore.SimpleQuery, opts *ScrollOptions) (<-chan *SearchHit[T], <-chan error) {
+	return scrollChannel(ctx, opts, func(fn func(hit *SearchHit[T]) error) error {
+		return st.Scroll(ctx, query, opts, func(key string, item *T) error {
+			return fn(&SearchHit[T]{ID: key, Index: st.Index, Source: item})
+		})
+	})
+}
+
+// SlicedExport exports every item matching the query with concurrent
+// workers. Deleted and expired items are filtered out. See SlicedExport for
+// the details
+func (st *ElasticJsonDataStore[T]) SlicedExport(ctx context.Context, query *datastore.SimpleQuery, opts *SlicedExportOptions, fn func(key string, item *T) error) (*ExportState, error) {
+	esQuery, err := st.convert(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	exportOpts := &SlicedExportOptions{}
+	if opts != nil {
+		*exportOpts = *opts
+	}
+	if exportOpts.Routing == "" {
+		exportOpts.Routing = st.searchOptions(ctx).Routing
+	}
+	decode := func(data []byte) (*SearchResponse[T], error) {
+		return st.decodeSearch(ctx, data)
+	}
+	return slicedExport(ctx, st.Client, st.Index, st.filteredBody(esQuery), exportOpts, decode, func(slice int, hit *SearchHit[T]) error {
+		return fn(hit.ID, hit.Source)
+	})
+}
+
+// filteredBody builds the body of the query, restricted to the documents
+// reads should return. The query itself is left untouched
+func (st *ElasticJsonDataStore[T]) filteredBody(query *ElasticSearchQueryBuilder) *gabs.Container {
+	body := query.BuildContainer()
+	if !st.hasControlFields() {
+		return body
+	}
+
+	filters := NewQuery()
+	st.applyFilters(filters)
+	filtered := filters.BuildContainer().S("query")
+	if original := body.S("query"); original != nil {
+		filtered.ArrayAppend(original.Data(), "bool", "must")
+	}
+	body.Set(filtered.Data(), "query")
+	return body
+}
+
+// marshal stamps the timestamps, runs the before save hooks, validates the
+// item and converts it into the stored document, including the control
+// fields of the store. As it changes the item, writes pass it a copy from
+// copyItem and only copy it back once they succeeded
+func (st *ElasticJsonDataStore[T]) marshal(ctx context.Context, key string, item *T) ([]byte, error) {
+	expiry, err := st.currentExpiry(ctx, []string{key}, []*T{item})
+	if err != nil {
+		return nil, err
+	}
+	return st.marshalDocument(ctx, key, item, expiry[key])
+}
+
+// marshalDocument is marshal with the expiry of the stored document, which
+// is kept when the item is saved without a time to live
+func (st *ElasticJsonDataStore[T]) marshalDocument(ctx context.Context, key string, item *T, expiresAt interface{}) ([]byte, error) {
+	if item != nil {
+		if err := stampTimes(item, time.Now().UTC()); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.beforeSave(ctx, key, item); err != nil {
+		return nil, err
+	}
+
+	invalid := &ValidationError{ID: key}
+	if item != nil {
+		checkItem(invalid, item)
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Validation.checkSchema(invalid, data); err != nil {
+		return nil, err
+	}
+
+	fields, err := st.encryptedFields()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) > 0 && item != nil {
+		data, err = encryptFields(ctx, st.Encryption, fields, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ttl := st.ttl(ctx); ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+	}
+	if expiresAt != nil && st.expires() && item != nil {
+		parsed, err := gabs.ParseJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Set(expiresAt, st.expiresAtField())
+		data = parsed.Bytes()
+	}
+
+	st.Validation.checkSize(invalid, data)
+	if err := invalid.orNil(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmarshal converts a stored document back into an item and runs the
+// after load hooks
+func (st *ElasticJsonDataStore[T]) unmarshal(ctx context.Context, data []byte) (*T, error) {
+	fields, err := st.encryptedFields()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) > 0 {
+		data, err = decryptFields(ctx, st.Encryption, fields, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	item, err := cloudy.UnmarshallT[T](data)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.afterLoad(ctx, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// parseResults converts the hits of a search response into items
+func (st *ElasticJsonDataStore[T]) parseResults(ctx context.Context, results string) ([]*T, error) {
+	sources, err := ParseResults(results)
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]*T, 0, len(sources))
+	for _, source := range sources {
+		item, err := st.unmarshal(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, item)
+	}
+	return rtn, nil
+}
+
+// decodeSearch decodes a search response, converting the sources into items
+func (st *ElasticJsonDataStore[T]) decodeSearch(ctx context.Context, data []byte) (*SearchResponse[T], error) {
+	raw, err := DecodeSearchResponse[json.RawMessage](data)
+	if err != nil {
+		return nil, err
+	}
+	return convertSearchResponse(raw, func(source *json.RawMessage) (*T, error) {
+		return st.unmarshal(ctx, *source)
+	})
+}
+
+// routing returns the routing for the key, the item is nil for reads,
+// deletes and partial updates
+func (st *ElasticJsonDataStore[T]) routing(ctx context.Context, key string, item *T) string {
+	if routing := routingFromContext(ctx); routing != "" {
+		return routing
+	}
+	if item != nil && st.ItemRoutingFunc != nil {
+		return st.ItemRoutingFunc(item)
+	}
+	if st.RoutingFunc != nil {
+		return st.RoutingFunc(key)
+	}
+	return ""
+}
+
+func (st *ElasticJsonDataStore[T]) writeOptions(ctx context.Context, key string, item *T) *WriteOptions {
+	opts := resolveWriteOptions(ctx, st.Refresh)
+	if opts.Routing == "" {
+		opts.Routing = st.routing(ctx, key, item)
+	}
+	if opts.Version == nil && item != nil && st.VersionFunc != nil {
+		version := st.VersionFunc(item)
+		opts.Version = &version
+		opts.VersionType = st.versionType()
+	}
+	return opts
+}
+
+// convert converts the simple query. Its text fields are sorted on their
+// keyword sub-field, which needs the mapping of the index
+func (st *ElasticJsonDataStore[T]) convert(ctx context.Context, query *datastore.SimpleQuery) (*ElasticSearchQueryBuilder, error) {
+	qc := &ElasticQueryConverter{}
+	if query != nil && len(query.SortBy) > 0 {
+		sortFields, err := st.sortFields(ctx, query.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		qc.SortFields = sortFields
+	}
+	return qc.ConvertBuilder(query)
+}
+
+// sortMapping caches the fields of the index mapping
+type sortMapping struct {
+	mu     sync.Mutex
+	fields map[string]bool
+	sort   map[string]string
+}
+
+// sortFields returns the keyword sort fields of the index. The mapping is
+// only loaded again when a query sorts on a field missing from it, e.g. one
+// added since by dynamic mapping
+func (st *ElasticJsonDataStore[T]) sortFields(ctx context.Context, sortBy []*datastore.SortBy) (map[string]string, error) {
+	st.mapping.mu.Lock()
+	defer st.mapping.mu.Unlock()
+
+	for _, s := range sortBy {
+		// Metadata fields such as _id and _score are never in the mapping
+		if st.mapping.fields[s.Field] || strings.HasPrefix(s.Field, "_") {
+			continue
+		}
+		paths, err := GetMappingPaths(ctx, st.Client, st.Index)
+		if err != nil {
+			return nil, err
+		}
+		st.mapping.fields = make(map[string]bool, len(paths))
+		for _, path := range paths {
+			st.mapping.fields[path.Path] = true
+		}
+		st.mapping.sort = KeywordSortFields(paths)
+		break
+	}
+	return st.mapping.sort, nil
+}
+
+// bulk writes the items with the bulk API, or one at a time when history is
+// enabled
+func (st *ElasticJsonDataStore[T]) bulk(ctx context.Context, operation string, items []*BulkItem) (*BulkResult, error) {
+	if st.History {
+		return st.bulkWithHistory(ctx, operation, items), nil
+	}
+	return Bulk(ctx, st.Client, st.Index, items, st.bulkOptions(ctx))
+}
+
+func (st *ElasticJsonDataStore[T]) conflictRetries() int {
+	if st.ConflictRetries <= 0 {
+		return 3
+	}
+	return st.ConflictRetries
+}
+
+func (st *ElasticJsonDataStore[T]) versionType() string {
+	if st.VersionType == "" {
+		return VersionTypeExternal
+	}
+	return st.VersionType
+}
+
+func (st *ElasticJsonDataStore[T]) getOptions(ctx context.Context, key string, opts *GetOptions) *GetOptions {
+	rtn := &GetOptions{}
+	if opts != nil {
+		*rtn = *opts
+	}
+	if len(rtn.SourceIncludes) > 0 && st.hasControlFields() {
+		// The control fields are needed to check if the item is visible
+		rtn.SourceIncludes = append(append([]string{}, rtn.SourceIncludes...), st.controlFields()...)
+	}
+	if rtn.Routing == "" {
+		rtn.Routing = st.routing(ctx, key, nil)
+	}
+	return rtn
+}
+
+func (st *ElasticJsonDataStore[T]) searchOptions(ctx context.Context) *SearchOptions {
+	return &SearchOptions{
+		Routing: routingFromContext(ctx),
+	}
+}
+
+func (st *ElasticJsonDataStore[T]) byQueryOptions(ctx context.Context, opts *ByQueryOptions) *ByQueryOptions {
+	rtn := &ByQueryOptions{}
+	if opts != nil {
+		*rtn = *opts
+	}
+	if rtn.Routing == "" {
+		rtn.Routing = routingFromContext(ctx)
+	}
+	return rtn
+}
+
+func (st *ElasticJsonDataStore[T]) bulkOptions(ctx context.Context) *BulkOptions {
+	return resolveBulkOptions(ctx, st.Bulk, st.Refresh)
 }
 
 type ElasticQueryConverter struct {
+	// Fields to sort on instead of the ones in the query, typically text
+	// fields that can only be sorted on their keyword sub-field. See
+	// KeywordSortFields
+	SortFields map[string]string
+}
+
+// KeywordSortFields maps the text fields of the mapping that have a keyword
+// sub-field to that sub-field, for ElasticQueryConverter.SortFields
+func KeywordSortFields(paths []*JsonPath) map[string]string {
+	keywords := make(map[string]bool)
+	for _, path := range paths {
+		if path.Type == "keyword" {
+			keywords[path.Path] = true
+		}
+	}
+
+	rtn := make(map[string]string)
+	for _, path := range paths {
+		if path.Type == "text" && keywords[path.Path+".keyword"] {
+			rtn[path.Path] = path.Path + ".keyword"
+		}
+	}
+	return rtn
 }
 
+// Convert converts the simple query, including its conditions and sorting,
+// into the JSON body of a search. A query that cannot be converted matches no
+// documents, use ConvertBuilder to get the error
 func (qc *ElasticQueryConverter) Convert(c *datastore.SimpleQuery) string {
+	q, err := qc.ConvertBuilder(c)
+	if err != nil {
+		q = NewQuery()
+		q.Query.MatchNone = true
+	}
+	return q.Build()
+}
+
+// ConvertBuilder converts the simple query, including its conditions and
+// sorting, into a query builder. A nil query, or one without conditions,
+// matches all the documents. ErrUnsupportedCondition is returned for the
+// conditions and groups that cannot be converted, so they never widen the
+// query
+func (qc *ElasticQueryConverter) ConvertBuilder(c *datastore.SimpleQuery) (*ElasticSearchQueryBuilder, error) {
 	q := NewQuery()
+	if c == nil {
+		q.Query.MatchAll = true
+		return q, nil
+	}
+
 	qc.ConvertSelect(c, q)
+	if c.Conditions != nil {
+		if err := qc.ConvertConditionGroupErr(c.Conditions, q.Query.Bool); err != nil {
+			return nil, err
+		}
+	}
+	if !q.Query.Valid() {
+		q.Query.MatchAll = true
+	}
+	qc.ConvertSort(c.SortBy, q)
 
-	return q.Build()
+	return q, nil
 }
 
 func (qc *ElasticQueryConverter) ConvertSelect(c *datastore.SimpleQuery, q *ElasticSearchQueryBuilder) {
@@ -185,20 +1156,61 @@ func (qc *ElasticQueryConverter) ConvertSort(sortbys []*datastore.SortBy, q *Ela
 	}
 }
 func (qc *ElasticQueryConverter) ConvertASort(c *datastore.SortBy, q *ElasticSearchQueryBuilder) {
+	field := c.Field
+	if sortField, ok := qc.SortFields[field]; ok {
+		field = sortField
+	}
 	if c.Descending {
-		q.AddSort(c.Field, "DESC")
+		q.AddSort(field, "DESC")
 	} else {
-		q.AddSort(c.Field, "ASC")
+		q.AddSort(field, "ASC")
 	}
 }
 
+// conditionValues are the supported condition types, with the number of
+// values they need including the field
+var conditionValues = map[string]int{
+	"eq":       2,
+	"neq":      2,
+	"between":  3,
+	"lt":       2,
+	"lte":      2,
+	"gt":       2,
+	"gte":      2,
+	"?":        1,
+	"null":     1,
+	"contains": 2,
+	"includes": 1,
+	"after":    1,
+	"before":   1,
+}
+
+// ConvertCondition adds the condition to the collector. Conditions that
+// cannot be converted are skipped, use ConvertConditionErr to get the error
 func (qc *ElasticQueryConverter) ConvertCondition(c *datastore.SimpleQueryCondition, collector *ConditionCollector) {
+	_ = qc.ConvertConditionErr(c, collector)
+}
+
+// ConvertConditionErr adds the condition to the collector, or returns
+// ErrUnsupportedCondition when it cannot be converted. An exists ("?")
+// condition with a value checks the key of that name in the object field
+func (qc *ElasticQueryConverter) ConvertConditionErr(c *datastore.SimpleQueryCondition, collector *ConditionCollector) error {
+	n, ok := conditionValues[c.Type]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnsupportedCondition, c.Type)
+	}
+	if len(c.Data) < n {
+		return fmt.Errorf("%w: %v needs %v values, got %v", ErrUnsupportedCondition, c.Type, n, len(c.Data))
+	}
+
 	field := c.Data[0]
 	switch c.Type {
 	case "eq":
 		collector.Match(field, c.Data[1])
 	case "neq":
-		// "???"
+		not := NewBooleanCollector()
+		not.MustNot.Match(field, c.Data[1])
+		collector.Add(not)
 	case "between":
 		collector.Range(field, c.Data[1], c.Data[2])
 	case "lt":
@@ -210,32 +1222,92 @@ func (qc *ElasticQueryConverter) ConvertCondition(c *datastore.SimpleQueryCondit
 	case "gte":
 		collector.Range(field, c.Data[1], "")
 	case "?":
-		// return fmt.Sprintf("(data->>'%v')::numeric  ? '%v'", field, c.Data[1])
+		if len(c.Data) > 1 && c.Data[1] != "" {
+			field = field + "." + c.Data[1]
+		}
+		collector.Exists(field)
+	case "null":
+		not := NewBooleanCollector()
+		not.MustNot.Exists(field)
+		collector.Add(not)
 	case "contains":
 		collector.Match(field, c.Data[1])
+	case "includes":
+		values, ok := c.DataMap["value"].([]string)
+		if !ok {
+			return fmt.Errorf("%w: %v needs a list of values", ErrUnsupportedCondition, c.Type)
+		}
+		collector.Terms(field, values...)
+	case "after", "before":
+		value, ok := c.DataMap["value"].(time.Time)
+		if !ok {
+			return fmt.Errorf("%w: %v needs a time", ErrUnsupportedCondition, c.Type)
+		}
+		date := value.Format(conditionDateFormat)
+		if c.Type == "after" {
+			collector.RangeExt(field, "", "", date, "")
+		} else {
+			collector.RangeExt(field, "", "", "", date)
+		}
 	}
-
+	return nil
 }
 
+// conditionDateFormat is the format of the times of after and before
+// conditions, which Elastic Search stores in milliseconds
+const conditionDateFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// ConvertConditionGroup adds the group to the boolean collector. Conditions
+// that cannot be converted are skipped, use ConvertConditionGroupErr to get
+// the error
 func (qc *ElasticQueryConverter) ConvertConditionGroup(cg *datastore.SimpleQueryConditionGroup, bg *BooleanCollector) {
+	_ = qc.convertConditionGroup(cg, bg, false)
+}
+
+// ConvertConditionGroupErr adds the group to the boolean collector, or
+// returns ErrUnsupportedCondition when it cannot be converted. A "not" group
+// matches the documents that match none of its conditions and groups
+func (qc *ElasticQueryConverter) ConvertConditionGroupErr(cg *datastore.SimpleQueryConditionGroup, bg *BooleanCollector) error {
+	return qc.convertConditionGroup(cg, bg, true)
+}
+
+// convertConditionGroup converts the group, skipping what it cannot convert
+// unless strict
+func (qc *ElasticQueryConverter) convertConditionGroup(cg *datastore.SimpleQueryConditionGroup, bg *BooleanCollector, strict bool) error {
 	if len(cg.Conditions) == 0 && len(cg.Groups) == 0 {
-		return
+		return nil
+	}
+
+	var collector *ConditionCollector
+	switch cg.Operator {
+	case "and":
+		collector = bg.Must
+	case "or":
+		collector = bg.Should
+		bg.MinShouldInclude = 1
+	case "not":
+		collector = bg.MustNot
+	default:
+		if !strict {
+			return nil
+		}
+		return fmt.Errorf("%w: group operator %v", ErrUnsupportedCondition, cg.Operator)
 	}
 
 	for _, c := range cg.Conditions {
-		if cg.Operator == "and" {
-			collector := bg.Must
-			qc.ConvertCondition(c, collector)
-		} else if cg.Operator == "or" {
-			collector := bg.Should
-			qc.ConvertCondition(c, collector)
-			bg.MinShouldInclude = 1
+		if err := qc.ConvertConditionErr(c, collector); err != nil && strict {
+			return err
 		}
 	}
 	for _, c := range cg.Groups {
 		// Create new collector
 		newBg := NewBooleanCollector()
-		qc.ConvertConditionGroup(c, newBg)
-		bg.Must.Add(newBg)
+		if err := qc.convertConditionGroup(c, newBg, strict); err != nil {
+			return err
+		}
+		if newBg.Valid() {
+			collector.Add(newBg)
+		}
 	}
+	return nil
 }
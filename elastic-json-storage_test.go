@@ -2,26 +2,34 @@ package cloudyelastic
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/datastore"
+	"github.com/go-openapi/spec"
 )
 
-// docker run -d --name elasticsearch  -p 9200:9200 -p 9300:9300 -e "discovery.type=single-node" elasticsearch:7.14.2
+// docker run -d --name elasticsearch  -p 9200:9200 -p 9300:9300 -e "discovery.type=single-node" elasticsearch:7.17.9
 var info = &ConnectionInfo{
 	Endpoint: "http://localhost:9201",
 }
 
 func startDocker() error {
 	fmt.Println("Starting Elasticsearch instance in docker for testing")
-	cmd := exec.Command("podman", "run", "--rm", "--name", "cloudy-test-elasticsearch", "-e", "discovery.type=single-node", "-d", "-p", "9201:9200", "elasticsearch:7.14.2")
+	cmd := exec.Command("podman", "run", "--rm", "--name", "cloudy-test-elasticsearch", "-e", "discovery.type=single-node", "-d", "-p", "9201:9200", "elasticsearch:7.17.9")
 	var out bytes.Buffer
 	var errs bytes.Buffer
 
@@ -63,11 +71,14 @@ func shutdownDocker() error {
 }
 
 func TestMain(m *testing.M) {
+	flag.Parse()
 
 	// Write code here to run before tests
-	err := startDocker()
-	if err != nil {
-		panic(err)
+	if !testing.Short() {
+		err := startDocker()
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	// Run tests
@@ -83,7 +94,17 @@ func TestMain(m *testing.M) {
 	os.Exit(exitVal)
 }
 
+// requireElastic skips the test in short mode, which runs without an
+// Elasticsearch instance
+func requireElastic(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("needs an Elasticsearch instance")
+	}
+}
+
 func TestJsonDataStore(t *testing.T) {
+	requireElastic(t)
 	ctx := cloudy.StartContext()
 
 	ds := NewElasticJsonDataStore[datastore.TestItem](
@@ -96,6 +117,7 @@ func TestJsonDataStore(t *testing.T) {
 }
 
 func TestJsonDataStoreQuery(t *testing.T) {
+	requireElastic(t)
 	ctx := cloudy.StartContext()
 
 	ds := NewElasticJsonDataStore[datastore.TestQueryItem](
@@ -106,3 +128,2203 @@ func TestJsonDataStoreQuery(t *testing.T) {
 
 	datastore.QueryJsonDataStoreTest(t, ctx, ds)
 }
+
+func TestJsonDataStoreBulk(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testbulk",
+	)
+
+	ds.Open(ctx, info)
+
+	var items []*datastore.TestItem
+	var keys []string
+	for i := 0; i < 25; i++ {
+		item := &datastore.TestItem{ID: fmt.Sprintf("bulk-%v", i), Name: "BULK"}
+		items = append(items, item)
+		keys = append(keys, item.ID)
+	}
+
+	result, err := ds.SaveMany(ctx, items, keys)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if result.HasErrors() || result.Stats.NumIndexed != 25 {
+		t.Fatalf("expected 25 indexed documents, got %v (%v)", result.Stats.NumIndexed, result.Err())
+	}
+
+	// Small batches are flushed by the same indexer
+	ds.Bulk = &BulkOptions{BatchSize: 5, NumWorkers: 1}
+	result, err = ds.SaveMany(ctx, items, keys)
+	if err != nil || result.HasErrors() || result.Stats.NumIndexed != 25 {
+		t.Fatalf("expected 25 indexed documents in batches, got %v: %v", result.Stats.NumIndexed, err)
+	}
+	if result.Stats.NumRequests < 3 {
+		t.Fatalf("expected several bulk requests, got %v", result.Stats.NumRequests)
+	}
+	ds.Bulk = nil
+
+	found, err := ds.GetMany(ctx, []string{"bulk-3", "bulk-missing", "bulk-1"})
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if !found[0].Found || found[0].Item.ID != "bulk-3" || found[1].Found || !found[2].Found {
+		t.Fatalf("unexpected multi get results")
+	}
+
+	// A document that cannot be decoded only fails its own item
+	err = IndexData(ds.Client, []byte(`{"ID":"bulk-bad","Name":{"not":"a string"}}`), "bulk-bad", ds.Index)
+	if err != nil {
+		t.Fatalf("unexpected error indexing: %v", err)
+	}
+	found, err = ds.GetMany(ctx, []string{"bulk-bad", "bulk-2"})
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if found[0].Err == nil || found[0].Found || !found[1].Found || found[1].Err != nil {
+		t.Fatalf("expected only the bad item to fail, got %+v %+v", found[0], found[1])
+	}
+	ds.Delete(ctx, "bulk-bad")
+
+	// Elastic Search errors for single documents are reported per item too
+	missing := NewElasticJsonDataStore[datastore.TestItem]("testbulk-missing-index")
+	missing.Client = ds.Client
+	found, err = missing.GetMany(ctx, []string{"bulk-1"})
+	if err != nil {
+		t.Fatalf("unexpected error loading from a missing index: %v", err)
+	}
+	if found[0].Found || !errors.Is(found[0].Err, ErrIndexNotFound) {
+		t.Fatalf("expected an index not found item error, got %v", found[0].Err)
+	}
+
+	result, err = ds.DeleteMany(ctx, keys)
+	if err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	if result.Stats.NumDeleted != 25 {
+		t.Fatalf("expected 25 deleted documents, got %v", result.Stats.NumDeleted)
+	}
+}
+
+func TestJsonDataStoreGetMany(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testgetmany",
+	)
+
+	ds.Open(ctx, info)
+
+	items := []*datastore.TestItem{{ID: "many-1", Name: "FIRST"}, {ID: "many-2", Name: "SECOND"}, {ID: "many-3", Name: "THIRD"}}
+	_, err := ds.SaveMany(ctx, items, []string{"many-1", "many-2", "many-3"})
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// Found and missing keys keep the order of the keys, repeated keys included
+	keys := []string{"many-3", "many-missing", "many-1", "many-3"}
+	found, err := ds.GetMany(ctx, keys)
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if len(found) != len(keys) {
+		t.Fatalf("expected %v results, got %v", len(keys), len(found))
+	}
+	for i, key := range keys {
+		if found[i].Key != key || found[i].Err != nil {
+			t.Fatalf("expected result %v for %v, got %+v", i, key, found[i])
+		}
+	}
+	if !found[0].Found || found[0].Item.Name != "THIRD" || !found[2].Found || found[2].Item.Name != "FIRST" || !found[3].Found {
+		t.Fatalf("expected the found items in the order of the keys")
+	}
+	if found[1].Found || found[1].Item != nil {
+		t.Fatalf("expected the missing key to have no item, got %+v", found[1])
+	}
+
+	found, err = ds.GetMany(ctx, nil)
+	if err != nil || len(found) != 0 {
+		t.Fatalf("expected no results without keys, got %v: %v", found, err)
+	}
+
+	docs, err := MultiLoadByID(ctx, ds.Client, []string{"many-2", "many-missing"}, ds.Index, nil)
+	if err != nil {
+		t.Fatalf("unexpected error loading the documents: %v", err)
+	}
+	if len(docs) != 2 || !docs[0].Found || docs[0].ID != "many-2" || docs[1].Found || docs[1].Error != nil {
+		t.Fatalf("unexpected documents %+v", docs)
+	}
+
+	// Routed keys are loaded with their own routing, which the index requires
+	err = CreateIndexWithMapping(ds.Client, "testgetmany-routed", `{"mappings":{"_routing":{"required":true}}}`)
+	if err != nil {
+		t.Fatalf("unexpected error creating the index: %v", err)
+	}
+	routed := NewElasticJsonDataStore[datastore.TestItem](
+		"testgetmany-routed",
+	)
+	routed.RoutingFunc = func(key string) string {
+		return strings.SplitN(key, ":", 2)[0]
+	}
+	routed.Open(ctx, info)
+
+	_, err = routed.SaveMany(ctx, []*datastore.TestItem{{ID: "acme:1", Name: "ACME"}, {ID: "globex:2", Name: "GLOBEX"}}, []string{"acme:1", "globex:2"})
+	if err != nil {
+		t.Fatalf("unexpected error saving routed items: %v", err)
+	}
+	found, err = routed.GetMany(ctx, []string{"globex:2", "acme:missing", "acme:1"})
+	if err != nil {
+		t.Fatalf("unexpected error loading routed items: %v", err)
+	}
+	if !found[0].Found || found[0].Item.Name != "GLOBEX" || found[1].Found || found[1].Err != nil || !found[2].Found || found[2].Item.Name != "ACME" {
+		t.Fatalf("expected the routed items, got %+v %+v %+v", found[0], found[1], found[2])
+	}
+	docs, err = MultiLoadByID(ctx, routed.Client, []string{"acme:1"}, routed.Index, nil)
+	if err != nil || docs[0].Error == nil {
+		t.Fatalf("expected the document to need its routing, got %+v: %v", docs, err)
+	}
+}
+
+func TestJsonDataStoreBulkOptions(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testbulkoptions",
+	)
+
+	ds.Open(ctx, info)
+
+	if refresh := ds.bulkOptions(ctx).Refresh; refresh != RefreshImmediate {
+		t.Fatalf("expected the bulk writes to refresh by default, got %v", refresh)
+	}
+	ds.Refresh = RefreshWaitFor
+	if refresh := ds.bulkOptions(ctx).Refresh; refresh != RefreshWaitFor {
+		t.Fatalf("expected the store refresh policy, got %v", refresh)
+	}
+	ds.Bulk = &BulkOptions{Refresh: RefreshNone}
+	if refresh := ds.bulkOptions(ctx).Refresh; refresh != RefreshNone {
+		t.Fatalf("expected the bulk refresh policy, got %v", refresh)
+	}
+	if refresh := ds.bulkOptions(WithRefresh(ctx, RefreshImmediate)).Refresh; refresh != RefreshImmediate {
+		t.Fatalf("expected the per call refresh policy to win, got %v", refresh)
+	}
+
+	indexer := &ESIndexer{Bulk: &BulkOptions{Refresh: RefreshNone}}
+	if refresh := indexer.bulkOptions(WithRefresh(ctx, RefreshWaitFor)).Refresh; refresh != RefreshWaitFor {
+		t.Fatalf("expected the per call refresh policy to win for the indexer, got %v", refresh)
+	}
+
+	// The single document conditions do not leak into the other writes
+	seqNo, primaryTerm := 1000, 1000
+	optsCtx := WithWriteOptions(ctx, &WriteOptions{
+		Refresh:       RefreshImmediate,
+		IfSeqNo:       &seqNo,
+		IfPrimaryTerm: &primaryTerm,
+		OpType:        "create",
+	})
+	opts := ds.writeOptions(optsCtx, "opts-1", nil)
+	if opts.IfSeqNo != nil || opts.IfPrimaryTerm != nil || opts.OpType != "" || opts.Refresh != RefreshImmediate {
+		t.Fatalf("unexpected write options %+v", opts)
+	}
+
+	items := []*datastore.TestItem{{ID: "opts-1", Name: "A"}, {ID: "opts-2", Name: "B"}}
+	for i := 0; i < 2; i++ {
+		err := ds.Save(optsCtx, items[0], items[0].ID)
+		if err != nil {
+			t.Fatalf("unexpected error saving with the context: %v", err)
+		}
+		result, err := ds.SaveMany(optsCtx, items, []string{"opts-1", "opts-2"})
+		if err != nil {
+			t.Fatalf("unexpected error saving many with the context: %v", err)
+		}
+		if result.HasErrors() {
+			t.Fatalf("unexpected failed items saving many with the context: %v", result.Err())
+		}
+	}
+	count, err := ds.Count(ctx, nil)
+	if err != nil || count != 2 {
+		t.Fatalf("expected the refreshed items to be counted, got %v: %v", count, err)
+	}
+}
+
+func TestBulkFlushBytes(t *testing.T) {
+	items := []*BulkItem{
+		{Action: BulkActionIndex, ID: "a", Data: make([]byte, 35)},
+		{Action: BulkActionIndex, ID: "b", Routing: "r", Data: make([]byte, 134)},
+	}
+	if flush := bulkFlushBytes(items, &BulkOptions{BatchSize: 10}); flush != 10*(bulkActionBytes+86) {
+		t.Fatalf("expected the flush threshold of 10 average items, got %v", flush)
+	}
+	if flush := bulkFlushBytes(items, &BulkOptions{BatchSize: 10, FlushBytes: 4096}); flush != 4096 {
+		t.Fatalf("expected the flush bytes to win, got %v", flush)
+	}
+	if flush := bulkFlushBytes(items, &BulkOptions{}); flush != 0 {
+		t.Fatalf("expected the indexer default without a batch size, got %v", flush)
+	}
+}
+
+func TestJsonDataStoreOptimisticConcurrency(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testocc",
+	)
+
+	ds.Open(ctx, info)
+
+	item := &datastore.TestItem{ID: "occ-1", Name: "ORIGINAL"}
+	err := ds.Save(ctx, item, item.ID)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	current, err := ds.GetVersioned(ctx, item.ID)
+	if err != nil || current == nil {
+		t.Fatalf("unable to load versioned item: %v", err)
+	}
+
+	// Someone else changes the document
+	item.Name = "CHANGED"
+	err = ds.Save(ctx, item, item.ID)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	current.Item.Name = "STALE"
+	err = ds.SaveIfMatch(ctx, current.Item, item.ID, current.SeqNo, current.PrimaryTerm)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected a version conflict, got %v", err)
+	}
+
+	updated, err := ds.Mutate(ctx, item.ID, func(item *datastore.TestItem) error {
+		item.Name = item.Name + "-MUTATED"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error mutating: %v", err)
+	}
+	if updated.Name != "CHANGED-MUTATED" {
+		t.Fatalf("unexpected name %v", updated.Name)
+	}
+}
+
+func TestJsonDataStoreCreate(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testcreate",
+	)
+
+	ds.Open(ctx, info)
+	ds.DeleteMany(ctx, []string{"create-1", "create-2"})
+
+	item := &datastore.TestItem{ID: "create-1", Name: "FIRST"}
+	err := ds.Create(ctx, item, item.ID)
+	if err != nil {
+		t.Fatalf("unexpected error creating: %v", err)
+	}
+
+	err = ds.Create(ctx, item, item.ID)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected already exists, got %v", err)
+	}
+
+	item2 := &datastore.TestItem{ID: "create-2", Name: "SECOND"}
+	result, err := ds.CreateMany(ctx, []*datastore.TestItem{item, item2}, []string{item.ID, item2.ID})
+	if err != nil {
+		t.Fatalf("unexpected error creating: %v", err)
+	}
+	existing := result.Existing()
+	if len(existing) != 1 || existing[0] != item.ID {
+		t.Fatalf("expected %v to already exist, got %v", item.ID, existing)
+	}
+}
+
+type patchedTestItem struct {
+	ID    string
+	Name  string
+	Count int
+}
+
+func TestJsonDataStorePartialUpdates(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[patchedTestItem](
+		"testpartial",
+	)
+
+	ds.Open(ctx, info)
+	ds.DeleteMany(ctx, []string{"partial-1", "partial-2", "partial-3"})
+
+	err := ds.Save(ctx, &patchedTestItem{ID: "partial-1", Name: "ORIGINAL", Count: 1}, "partial-1")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// Only the given field changes
+	err = ds.Patch(ctx, "partial-1", map[string]interface{}{"Name": "PATCHED"})
+	if err != nil {
+		t.Fatalf("unexpected error patching: %v", err)
+	}
+	item, err := ds.Get(ctx, "partial-1")
+	if err != nil || item == nil || item.Name != "PATCHED" || item.Count != 1 || item.ID != "partial-1" {
+		t.Fatalf("expected only the name to be patched, got %v: %v", item, err)
+	}
+
+	err = ds.Patch(ctx, "partial-missing", map[string]interface{}{"Name": "PATCHED"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected patching a missing item to fail with not found, got %v", err)
+	}
+
+	// Upsert creates the missing document from the partial item
+	err = ds.Upsert(ctx, "partial-2", map[string]interface{}{"ID": "partial-2", "Name": "UPSERTED"})
+	if err != nil {
+		t.Fatalf("unexpected error upserting: %v", err)
+	}
+	item, err = ds.Get(ctx, "partial-2")
+	if err != nil || item == nil || item.Name != "UPSERTED" {
+		t.Fatalf("expected the upserted item, got %v: %v", item, err)
+	}
+
+	script := &Script{
+		Source: "ctx._source.Count += params.by",
+		Params: map[string]interface{}{"by": 5},
+	}
+	err = ds.UpdateWithScript(ctx, "partial-1", script, nil)
+	if err != nil {
+		t.Fatalf("unexpected error running the script: %v", err)
+	}
+	item, err = ds.Get(ctx, "partial-1")
+	if err != nil || item == nil || item.Count != 6 || item.Name != "PATCHED" {
+		t.Fatalf("expected the count to be incremented by the param, got %v: %v", item, err)
+	}
+
+	// The upsert is saved as is, without running the script
+	err = ds.UpdateWithScript(ctx, "partial-3", script, &patchedTestItem{ID: "partial-3", Count: 1})
+	if err != nil {
+		t.Fatalf("unexpected error upserting with a script: %v", err)
+	}
+	item, err = ds.Get(ctx, "partial-3")
+	if err != nil || item == nil || item.Count != 1 {
+		t.Fatalf("expected the upsert item, got %v: %v", item, err)
+	}
+
+	// The package helpers
+	_, err = PatchData(ctx, ds.Client, map[string]interface{}{"Count": 10}, "partial-3", ds.Index, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error patching the data: %v", err)
+	}
+	_, err = ScriptUpdateData(ctx, ds.Client, script, nil, "partial-3", ds.Index, nil)
+	if err != nil {
+		t.Fatalf("unexpected error running the script: %v", err)
+	}
+	item, err = ds.Get(ctx, "partial-3")
+	if err != nil || item == nil || item.Count != 15 {
+		t.Fatalf("expected a count of 15, got %v: %v", item, err)
+	}
+}
+
+func TestJsonDataStoreGetNotFound(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"test",
+	)
+
+	ds.Open(ctx, info)
+
+	// Get follows the datastore.JsonDataStore contract
+	item, err := ds.Get(ctx, "does-not-exist")
+	if err != nil || item != nil {
+		t.Fatalf("expected no item and no error, got %v: %v", item, err)
+	}
+
+	item, err = ds.MustGet(ctx, "does-not-exist")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if item != nil {
+		t.Fatalf("expected no item")
+	}
+}
+
+func TestJsonDataStoreDeleteByQuery(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testbyquery",
+	)
+
+	ds.Open(ctx, info)
+
+	items := []*datastore.TestItem{
+		{ID: "bq-1", Name: "keep"},
+		{ID: "bq-2", Name: "purge"},
+		{ID: "bq-3", Name: "purge"},
+	}
+	_, err := ds.SaveMany(ctx, items, []string{"bq-1", "bq-2", "bq-3"})
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	query := datastore.NewQuery()
+	query.Conditions.Equals("Name", "purge")
+
+	resp, err := ds.DeleteByQuery(ctx, query, &ByQueryOptions{Refresh: true})
+	if err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	if resp.Deleted != 2 {
+		t.Fatalf("expected 2 deleted, got %v", resp.Deleted)
+	}
+
+	exists, err := ds.Exists(ctx, "bq-1")
+	if err != nil || !exists {
+		t.Fatalf("expected bq-1 to be kept: %v", err)
+	}
+}
+
+func TestJsonDataStoreByQueryTasks(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[patchedTestItem](
+		"testbyquerytasks",
+	)
+
+	ds.Open(ctx, info)
+
+	// Conditions that cannot be converted never widen the query
+	unsupported := datastore.NewQuery()
+	unsupported.Conditions.Conditions = append(unsupported.Conditions.Conditions, &datastore.SimpleQueryCondition{
+		Type: "like",
+		Data: []string{"Name", "task%"},
+	})
+	_, err := ds.DeleteByQuery(ctx, unsupported, nil)
+	if !errors.Is(err, ErrUnsupportedCondition) {
+		t.Fatalf("expected an unsupported condition, got %v", err)
+	}
+	_, err = ds.UpdateByQuery(ctx, unsupported, nil, nil)
+	if !errors.Is(err, ErrUnsupportedCondition) {
+		t.Fatalf("expected an unsupported condition, got %v", err)
+	}
+	_, err = ds.Query(ctx, unsupported)
+	if !errors.Is(err, ErrUnsupportedCondition) {
+		t.Fatalf("expected an unsupported condition, got %v", err)
+	}
+
+	// Queries matching everything need an explicit opt in
+	_, err = ds.DeleteByQuery(ctx, datastore.NewQuery(), nil)
+	if !errors.Is(err, ErrUnrestrictedQuery) {
+		t.Fatalf("expected an unrestricted query to be refused, got %v", err)
+	}
+	_, err = ds.UpdateByQuery(ctx, nil, nil, nil)
+	if !errors.Is(err, ErrUnrestrictedQuery) {
+		t.Fatalf("expected an unrestricted query to be refused, got %v", err)
+	}
+
+	var items []*patchedTestItem
+	var keys []string
+	for i := 0; i < 1500; i++ {
+		item := &patchedTestItem{ID: fmt.Sprintf("task-%v", i), Name: "task", Count: i}
+		items = append(items, item)
+		keys = append(keys, item.ID)
+	}
+	_, err = ds.SaveMany(ctx, items, keys)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// Query applies the conditions and the sort of the simple query
+	query := datastore.NewQuery()
+	query.Conditions.GreaterThanOrEqual("Count", "1497")
+	query.SortBy = append(query.SortBy, &datastore.SortBy{Field: "Count", Descending: true})
+	found, err := ds.Query(ctx, query)
+	if err != nil {
+		t.Fatalf("unexpected error querying: %v", err)
+	}
+	if len(found) != 3 || found[0].Count != 1499 || found[2].Count != 1497 {
+		t.Fatalf("expected the 3 highest counts in descending order, got %v", found)
+	}
+
+	tasks := datastore.NewQuery()
+	tasks.Conditions.Equals("Name", "task")
+
+	// Throttled to a batch every ~1000 seconds until it is rethrottled
+	rps := 1
+	resp, err := ds.UpdateByQuery(ctx, tasks, &Script{Source: "ctx._source.Count += 1"}, &ByQueryOptions{
+		Async:             true,
+		RequestsPerSecond: &rps,
+		Refresh:           true,
+	})
+	if err != nil || resp.Task == "" {
+		t.Fatalf("expected a background task, got %v: %v", resp, err)
+	}
+	status, err := GetTask(ctx, ds.Client, resp.Task)
+	if err != nil || status.ID != resp.Task {
+		t.Fatalf("unexpected error getting the task: %v", err)
+	}
+	err = RethrottleUpdateByQuery(ctx, ds.Client, resp.Task, -1)
+	if err != nil {
+		t.Fatalf("unexpected error rethrottling: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	status, err = WaitForTask(waitCtx, ds.Client, resp.Task, 100*time.Millisecond)
+	if err != nil || !status.Completed || status.Response == nil || status.Response.Updated != 1500 {
+		t.Fatalf("expected 1500 updated items, got %+v: %v", status, err)
+	}
+
+	resp, err = ds.DeleteByQuery(ctx, tasks, &ByQueryOptions{
+		Async:             true,
+		RequestsPerSecond: &rps,
+	})
+	if err != nil || resp.Task == "" {
+		t.Fatalf("expected a background task, got %v: %v", resp, err)
+	}
+	err = RethrottleDeleteByQuery(ctx, ds.Client, resp.Task, 1)
+	if err != nil {
+		t.Fatalf("unexpected error rethrottling: %v", err)
+	}
+	err = CancelTask(ctx, ds.Client, resp.Task)
+	if err != nil {
+		t.Fatalf("unexpected error cancelling: %v", err)
+	}
+	status, err = WaitForTask(waitCtx, ds.Client, resp.Task, 100*time.Millisecond)
+	if err != nil || status.Response == nil || status.Response.Canceled == "" || status.Response.Deleted >= 1500 {
+		t.Fatalf("expected the delete to be cancelled, got %+v: %v", status, err)
+	}
+
+	resp, err = ds.DeleteByQuery(ctx, nil, &ByQueryOptions{AllowMatchAll: true, Refresh: true})
+	if err != nil || resp.Deleted == 0 {
+		t.Fatalf("expected the remaining items to be deleted, got %v: %v", resp, err)
+	}
+}
+
+func TestByQueryBody(t *testing.T) {
+	restricted := NewQuery()
+	restricted.Query.Bool.Filter.Range("Count", "10", "")
+	restricted.Size = 5
+
+	simple := datastore.NewQuery()
+	simple.Conditions.Equals("Name", "purge")
+	simple.SortBy = append(simple.SortBy, &datastore.SortBy{Field: "Name"})
+
+	tests := []struct {
+		name  string
+		query interface{}
+		all   bool
+		body  string
+	}{
+		{"builder", restricted, false, `{"query":{"bool":{"filter":[{"range":{"Count":{"gte":"10"}}}]}}}`},
+		{"string", `{"query":{"term":{"Name":"purge"}},"size":3}`, false, `{"query":{"term":{"Name":"purge"}}}`},
+		{"simple query", simple, false, `{"query":{"bool":{"must":[{"match":{"Name":"purge"}}]}}}`},
+		{"nil", nil, true, `{"query":{"match_all":{}}}`},
+		{"empty string", `{}`, true, `{"query":{"match_all":{}}}`},
+		{"empty simple query", datastore.NewQuery(), true, `{"query":{"match_all":{}}}`},
+		{"match all string", `{"query":{"match_all":{}}}`, true, `{"query":{"match_all":{}}}`},
+		{"empty query string", `{"query":{}}`, true, `{"query":{}}`},
+	}
+	for _, test := range tests {
+		body, err := byQueryBody(test.query)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.name, err)
+		}
+		if body.String() != test.body {
+			t.Errorf("%v: expected body %v, got %v", test.name, test.body, body.String())
+		}
+		if matchesAll(body) != test.all {
+			t.Errorf("%v: expected matches all to be %v", test.name, test.all)
+		}
+	}
+
+	_, err := byQueryBody(42)
+	if err == nil {
+		t.Fatalf("expected an unsupported query type to fail")
+	}
+}
+
+func TestElasticQueryConverter(t *testing.T) {
+	when := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+
+	query := datastore.NewQuery()
+	query.Conditions.Conditions = append(query.Conditions.Conditions, &datastore.SimpleQueryCondition{
+		Type: "neq",
+		Data: []string{"Name", "old"},
+	})
+	query.Conditions.Exists("Tags", "")
+	query.Conditions.Exists("Labels", "color")
+	query.Conditions.Null("Deleted")
+	query.Conditions.Includes("Status", []string{"open", "held"})
+	query.Conditions.After("Created", when)
+	query.Conditions.Before("Updated", when)
+	or := query.Conditions.Or()
+	or.Equals("Owner", "a")
+	or.Equals("Owner", "b")
+	not := query.Conditions.Not()
+	not.Equals("Kind", "draft")
+	not.Null("Parent")
+
+	qc := &ElasticQueryConverter{}
+	q, err := qc.ConvertBuilder(query)
+	if err != nil {
+		t.Fatalf("unexpected error converting: %v", err)
+	}
+	expected := `{"bool":{"must":[` +
+		`{"bool":{"must_not":[{"match":{"Name":"old"}}]}},` +
+		`{"exists":{"field":"Tags"}},` +
+		`{"exists":{"field":"Labels.color"}},` +
+		`{"bool":{"must_not":[{"exists":{"field":"Deleted"}}]}},` +
+		`{"terms":{"Status":["open","held"]}},` +
+		`{"range":{"Created":{"gt":"2023-04-05T06:07:08.000Z"}}},` +
+		`{"range":{"Updated":{"lt":"2023-04-05T06:07:08.000Z"}}},` +
+		`{"bool":{"minimum_should_match":1,"should":[{"match":{"Owner":"a"}},{"match":{"Owner":"b"}}]}},` +
+		`{"bool":{"must_not":[{"match":{"Kind":"draft"}},{"bool":{"must_not":[{"exists":{"field":"Parent"}}]}}]}}` +
+		`]}}`
+	if actual := q.BuildContainer().S("query").String(); actual != expected {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+
+	// Unconvertible conditions are reported, or match nothing through Convert
+	query.Conditions.Conditions = append(query.Conditions.Conditions, &datastore.SimpleQueryCondition{
+		Type: "like",
+		Data: []string{"Name", "a%"},
+	})
+	_, err = qc.ConvertBuilder(query)
+	if !errors.Is(err, ErrUnsupportedCondition) {
+		t.Fatalf("expected an unsupported condition, got %v", err)
+	}
+	if !strings.Contains(qc.Convert(query), "match_none") {
+		t.Fatalf("expected the query to match nothing")
+	}
+	incomplete := datastore.NewQuery()
+	incomplete.Conditions.Conditions = append(incomplete.Conditions.Conditions, &datastore.SimpleQueryCondition{Type: "between", Data: []string{"Count", "1"}})
+	_, err = qc.ConvertBuilder(incomplete)
+	if !errors.Is(err, ErrUnsupportedCondition) {
+		t.Fatalf("expected an incomplete condition to be refused, got %v", err)
+	}
+
+	// The collector variants skip what they cannot convert
+	bg := NewBooleanCollector()
+	qc.ConvertConditionGroup(query.Conditions, bg)
+	if !bg.Must.Valid() || len(bg.Must.conditions) != 9 {
+		t.Fatalf("expected the convertible conditions and groups to be kept")
+	}
+}
+
+type versionedTestItem struct {
+	ID      string
+	Name    string
+	Version int64
+}
+
+func TestJsonDataStoreExternalVersion(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[versionedTestItem](
+		"testversioned",
+	)
+	ds.VersionFunc = func(item *versionedTestItem) int64 {
+		return item.Version
+	}
+
+	ds.Open(ctx, info)
+	ds.Delete(ctx, "ver-1")
+
+	err := ds.Save(ctx, &versionedTestItem{ID: "ver-1", Name: "NEWER", Version: 5}, "ver-1")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	err = ds.Save(ctx, &versionedTestItem{ID: "ver-1", Name: "OLDER", Version: 3}, "ver-1")
+	if !errors.Is(err, ErrStaleVersion) {
+		t.Fatalf("expected a stale version, got %v", err)
+	}
+
+	item, err := ds.Get(ctx, "ver-1")
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if item.Name != "NEWER" {
+		t.Fatalf("stale write overwrote the document")
+	}
+
+	// Versions beyond 32 bits are kept as is
+	err = ds.Save(ctx, &versionedTestItem{ID: "ver-1", Name: "LARGE", Version: 1 << 40}, "ver-1")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	versioned, err := ds.GetVersioned(ctx, "ver-1")
+	if err != nil || versioned.Version != 1<<40 {
+		t.Fatalf("expected the external version to be stored, got %v: %v", versioned, err)
+	}
+
+	// Stale items of a bulk save are reported apart from the failures
+	result, err := ds.SaveMany(ctx, []*versionedTestItem{
+		{ID: "ver-1", Name: "OLDER", Version: 3},
+		{ID: "ver-2", Name: "NEW", Version: 1},
+	}, []string{"ver-1", "ver-2"})
+	if err != nil {
+		t.Fatalf("unexpected error saving many: %v", err)
+	}
+	if result.HasErrors() || result.Err() != nil {
+		t.Fatalf("expected stale items not to be errors, got %v", result.Err())
+	}
+	stale := result.Stale()
+	if len(stale) != 1 || stale[0] != "ver-1" {
+		t.Fatalf("expected ver-1 to be stale, got %v", stale)
+	}
+	ds.Delete(ctx, "ver-2")
+
+	// The version of the context applies to the bulk writes of the indexer
+	indexer := &ESIndexer{IndexName: ds.Index, Client: ds.Client}
+	versionCtx := WithExternalVersion(ctx, 2, VersionTypeExternal)
+	result, err = indexer.IndexMany(versionCtx, []string{"ver-1", "ver-3"}, [][]byte{
+		[]byte(`{"ID":"ver-1","Name":"OLDER"}`),
+		[]byte(`{"ID":"ver-3","Name":"NEW"}`),
+	})
+	if err != nil || result.HasErrors() {
+		t.Fatalf("unexpected error indexing many: %v %v", err, result.Err())
+	}
+	if stale := result.Stale(); len(stale) != 1 || stale[0] != "ver-1" {
+		t.Fatalf("expected ver-1 to be stale for the indexer, got %v", stale)
+	}
+	versioned, err = ds.GetVersioned(ctx, "ver-3")
+	if err != nil || versioned.Version != 2 {
+		t.Fatalf("expected the version of the context to be stored, got %v: %v", versioned, err)
+	}
+	_, err = indexer.CreateMany(versionCtx, []string{"ver-4"}, [][]byte{[]byte(`{"ID":"ver-4"}`)})
+	if err == nil {
+		t.Fatalf("expected externally versioned creates to be refused")
+	}
+	ds.Delete(ctx, "ver-3")
+}
+
+type recordingTransport struct {
+	url string
+}
+
+func (t *recordingTransport) Perform(req *http.Request) (*http.Response, error) {
+	t.url = req.URL.String()
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(`{}`)), Header: http.Header{}}, nil
+}
+
+func TestVersionTransport(t *testing.T) {
+	recorder := &recordingTransport{}
+	transport := &versionTransport{Transport: recorder, version: 1<<53 + 1}
+	req, _ := http.NewRequest("PUT", "http://localhost/index/_doc/1?version_type=external", nil)
+	_, err := transport.Perform(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(recorder.url, "version=9007199254740993") || !strings.Contains(recorder.url, "version_type=external") {
+		t.Fatalf("expected the full version in the request, got %v", recorder.url)
+	}
+}
+
+func TestJsonDataStoreSoftDelete(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testsoftdelete",
+	)
+	ds.SoftDelete = true
+
+	ds.Open(ctx, info)
+
+	item := &datastore.TestItem{ID: "soft-1", Name: "SOFT"}
+	err := ds.Save(ctx, item, item.ID)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	err = ds.Delete(ctx, item.ID)
+	if err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+
+	_, err = ds.MustGet(ctx, item.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected deleted item to be hidden, got %v", err)
+	}
+	exists, _ := ds.Exists(ctx, item.ID)
+	if exists {
+		t.Fatalf("expected deleted item to not exist")
+	}
+
+	deleted, err := ds.ListDeleted(ctx)
+	if err != nil || len(deleted) == 0 {
+		t.Fatalf("expected deleted items: %v", err)
+	}
+
+	err = ds.Restore(ctx, item.ID)
+	if err != nil {
+		t.Fatalf("unexpected error restoring: %v", err)
+	}
+	restored, err := ds.Get(ctx, item.ID)
+	if err != nil || restored.Name != "SOFT" {
+		t.Fatalf("expected restored item: %v", err)
+	}
+
+	kept := &datastore.TestItem{ID: "soft-2", Name: "KEPT"}
+	err = ds.Save(ctx, kept, kept.ID)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	ds.Delete(ctx, item.ID)
+
+	// Items deleted more recently than the cutoff are kept
+	resp, err := ds.Purge(ctx, time.Hour)
+	if err != nil || resp.Deleted != 0 {
+		t.Fatalf("expected nothing to be purged, got %v: %v", resp, err)
+	}
+
+	resp, err = ds.Purge(ctx, 0)
+	if err != nil {
+		t.Fatalf("unexpected error purging: %v", err)
+	}
+	if resp.Deleted != 1 {
+		t.Fatalf("expected 1 purged item, got %v", resp.Deleted)
+	}
+	deleted, err = ds.ListDeleted(ctx)
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("expected no deleted items left, got %v: %v", len(deleted), err)
+	}
+	_, err = GetDocument(ctx, ds.Client, item.ID, ds.Index, nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the purged item to be removed, got %v", err)
+	}
+	exists, _ = ds.Exists(ctx, kept.ID)
+	if !exists {
+		t.Fatalf("expected the item that was not deleted to be kept")
+	}
+}
+
+func TestJsonDataStoreHistory(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testhistory",
+	)
+	ds.History = true
+
+	ds.Open(ctx, info)
+
+	key := fmt.Sprintf("hist-%v", time.Now().UnixNano())
+	ds.Save(ctx, &datastore.TestItem{ID: key, Name: "V1"}, key)
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	ds.Save(ctx, &datastore.TestItem{ID: key, Name: "V2"}, key)
+
+	history, err := ds.ListHistory(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected error listing history: %v", err)
+	}
+	if len(history) != 2 || history[0].Item.Name != "V1" || history[1].Item != nil {
+		t.Fatalf("unexpected history %v", history)
+	}
+
+	old, err := ds.GetAsOf(ctx, key, between)
+	if err != nil || old.Name != "V1" {
+		t.Fatalf("expected V1 as of the time between the saves: %v", err)
+	}
+}
+
+func TestJsonDataStoreHistoryConcurrent(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testhistory",
+	)
+	ds.History = true
+	ds.ConflictRetries = 20
+
+	ds.Open(ctx, info)
+
+	key := fmt.Sprintf("hist-concurrent-%v", time.Now().UnixNano())
+	writers := 5
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = ds.Save(ctx, &datastore.TestItem{ID: key, Name: fmt.Sprintf("V%v", i)}, key)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error saving: %v", err)
+		}
+	}
+
+	err := ds.Patch(ctx, key, map[string]interface{}{"Name": "PATCHED"})
+	if err != nil {
+		t.Fatalf("unexpected error patching: %v", err)
+	}
+
+	history, err := ds.ListHistory(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected error listing history: %v", err)
+	}
+	if len(history) != writers+1 {
+		t.Fatalf("expected %v history entries, got %v", writers+1, len(history))
+	}
+
+	versions := make(map[int64]bool)
+	updates := 0
+	for _, entry := range history {
+		if entry.Item == nil {
+			continue
+		}
+		if versions[entry.Version] {
+			t.Fatalf("version %v recorded twice", entry.Version)
+		}
+		versions[entry.Version] = true
+		if entry.Operation == HistoryOperationUpdate {
+			updates++
+		}
+	}
+	if len(versions) != writers || updates != 1 {
+		t.Fatalf("expected every previous version once and one update, got %v and %v", versions, updates)
+	}
+}
+
+func TestElasticSearchQueryBuilderSort(t *testing.T) {
+	q := NewQuery()
+	q.Query.MatchAll = true
+	q.AddSort("Name.keyword", "ASC")
+	q.AddSort("Created", "DESC")
+
+	expected := `[{"Name.keyword":{"order":"asc"}},{"Created":{"order":"desc"}}]`
+	if actual := q.BuildContainer().S("sort").String(); actual != expected {
+		t.Fatalf("expected sort %v, got %v", expected, actual)
+	}
+
+	// The converter sorts text fields on their keyword sub-field
+	query := datastore.NewQuery()
+	query.SortBy = append(query.SortBy, &datastore.SortBy{Field: "Name", Descending: true}, &datastore.SortBy{Field: "Count"})
+	qc := &ElasticQueryConverter{
+		SortFields: KeywordSortFields([]*JsonPath{
+			{Path: "Name", Type: "text"},
+			{Path: "Name.keyword", Type: "keyword"},
+			{Path: "Count", Type: "long"},
+		}),
+	}
+	converted, err := qc.ConvertBuilder(query)
+	if err != nil {
+		t.Fatalf("unexpected error converting: %v", err)
+	}
+	expected = `[{"Name.keyword":{"order":"desc"}},{"Count":{"order":"asc"}}]`
+	if actual := converted.BuildContainer().S("sort").String(); actual != expected {
+		t.Fatalf("expected sort %v, got %v", expected, actual)
+	}
+
+	if NewQuery().BuildContainer().Exists("sort") {
+		t.Fatalf("expected no sort without sort fields")
+	}
+}
+
+func TestJsonDataStoreSortText(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testsorttext",
+	)
+
+	ds.Open(ctx, info)
+
+	for _, name := range []string{"CHARLIE", "ALPHA", "BRAVO"} {
+		err := ds.Save(ctx, &datastore.TestItem{ID: name, Name: name}, name)
+		if err != nil {
+			t.Fatalf("unexpected error saving: %v", err)
+		}
+	}
+
+	query := datastore.NewQuery()
+	query.SortBy = append(query.SortBy, &datastore.SortBy{Field: "Name"})
+	items, err := ds.Query(ctx, query)
+	if err != nil {
+		t.Fatalf("unexpected error sorting on a text field: %v", err)
+	}
+	if len(items) != 3 || items[0].Name != "ALPHA" || items[2].Name != "CHARLIE" {
+		t.Fatalf("unexpected order %v", items)
+	}
+}
+
+func TestJsonDataStoreExpiry(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testexpiry",
+	)
+	ds.Expires = true
+
+	ds.Open(ctx, info)
+
+	err := ds.SaveWithTTL(ctx, &datastore.TestItem{ID: "ttl-1", Name: "SHORT"}, "ttl-1", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	item, err := ds.Get(ctx, "ttl-1")
+	if err != nil || item == nil {
+		t.Fatalf("expected the item before it expires: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+	_, err = ds.MustGet(ctx, "ttl-1")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the item to be expired, got %v", err)
+	}
+
+	resp, err := ds.DeleteExpired(ctx, 100)
+	if err != nil {
+		t.Fatalf("unexpected error removing expired items: %v", err)
+	}
+	if resp.Deleted == 0 {
+		t.Fatalf("expected expired items to be removed")
+	}
+
+	// The reaper removes expired items in the background
+	err = ds.SaveWithTTL(ctx, &datastore.TestItem{ID: "ttl-2", Name: "REAPED"}, "ttl-2", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	reaper := ds.StartReaper(ctx, 500*time.Millisecond, 10)
+	defer reaper.Stop()
+	for i := 0; ; i++ {
+		_, err = GetDocument(ctx, ds.Client, "ttl-2", ds.Index, nil)
+		if errors.Is(err, ErrNotFound) {
+			break
+		}
+		if i == 20 {
+			t.Fatalf("expected the reaper to remove the expired item, got %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func TestJsonDataStoreExpiryKept(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testexpiry",
+	)
+	ds.Expires = true
+
+	ds.Open(ctx, info)
+
+	expiresAt := func() interface{} {
+		doc, err := GetDocument(ctx, ds.Client, "ttl-kept", ds.Index, nil)
+		if err != nil {
+			t.Fatalf("unexpected error loading the document: %v", err)
+		}
+		var source map[string]interface{}
+		if err := json.Unmarshal(doc.Source, &source); err != nil {
+			t.Fatalf("unexpected error parsing the document: %v", err)
+		}
+		return source["_expiresAt"]
+	}
+
+	err := ds.SaveWithTTL(ctx, &datastore.TestItem{ID: "ttl-kept", Name: "V1"}, "ttl-kept", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	first := expiresAt()
+	if first == nil {
+		t.Fatalf("expected the item to expire")
+	}
+
+	err = ds.Save(ctx, &datastore.TestItem{ID: "ttl-kept", Name: "V2"}, "ttl-kept")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if kept := expiresAt(); kept != first {
+		t.Fatalf("expected the expiry %v to be kept, got %v", first, kept)
+	}
+
+	err = ds.SaveWithTTL(ctx, &datastore.TestItem{ID: "ttl-kept", Name: "V3"}, "ttl-kept", -1)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if cleared := expiresAt(); cleared != nil {
+		t.Fatalf("expected the expiry to be removed, got %v", cleared)
+	}
+}
+
+type encryptedTestItem struct {
+	ID     string                       `json:"id"`
+	Secret string                       `json:"secret" elastic:"encrypt"`
+	Email  string                       `json:"email" elastic:"encrypt,searchable"`
+	Notes  []*encryptedTestNote         `json:"notes"`
+	Labels map[string]encryptedTestNote `json:"labels"`
+}
+
+type encryptedTestNote struct {
+	Text string `json:"text" elastic:"encrypt"`
+}
+
+func TestJsonDataStoreEncryption(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	keys := NewStaticKeyProvider("k1", map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+	})
+	ds := NewElasticJsonDataStore[encryptedTestItem](
+		"testencryption",
+	)
+	ds.Encryption = NewAESGCMEncryptor(keys)
+
+	ds.Open(ctx, info)
+
+	err := ds.Save(ctx, &encryptedTestItem{
+		ID:     "enc-1",
+		Secret: "hunter2",
+		Email:  "a@b.c",
+		Notes:  []*encryptedTestNote{{Text: "note-secret"}},
+		Labels: map[string]encryptedTestNote{"home": {Text: "label-secret"}},
+	}, "enc-1")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	doc, err := GetDocument(ctx, ds.Client, "enc-1", ds.Index, nil)
+	if err != nil {
+		t.Fatalf("unexpected error getting the raw document: %v", err)
+	}
+	for _, secret := range []string{"hunter2", "note-secret", "label-secret"} {
+		if strings.Contains(string(doc.Source), secret) {
+			t.Fatalf("expected %v to be encrypted, got %v", secret, string(doc.Source))
+		}
+	}
+
+	item, err := ds.Get(ctx, "enc-1")
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if item.Secret != "hunter2" || item.Email != "a@b.c" {
+		t.Fatalf("expected the fields to be decrypted, got %+v", item)
+	}
+	if len(item.Notes) != 1 || item.Notes[0].Text != "note-secret" || item.Labels["home"].Text != "label-secret" {
+		t.Fatalf("expected the nested fields to be decrypted, got %+v", item)
+	}
+
+	err = ds.UpdateWithScript(ctx, "enc-2", &Script{Source: "ctx.op = 'none'"}, &encryptedTestItem{ID: "enc-2", Secret: "upserted"})
+	if err != nil {
+		t.Fatalf("unexpected error upserting: %v", err)
+	}
+	doc, err = GetDocument(ctx, ds.Client, "enc-2", ds.Index, nil)
+	if err != nil {
+		t.Fatalf("unexpected error getting the raw document: %v", err)
+	}
+	if strings.Contains(string(doc.Source), "upserted") {
+		t.Fatalf("expected the upsert to be encrypted, got %v", string(doc.Source))
+	}
+
+	email, err := ds.EncryptedValue(ctx, "email", "a@b.c")
+	if err != nil {
+		t.Fatalf("unexpected error encrypting: %v", err)
+	}
+	q := NewQuery()
+	q.Query.Bool.Must.Terms("email.keyword", email)
+	results, err := QueryWithOptions(ctx, ds.Client, ds.Index, q.Build(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error querying: %v", err)
+	}
+	items, err := ds.parseResults(ctx, results)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %v", err)
+	}
+	if len(items) != 1 || items[0].ID != "enc-1" {
+		t.Fatalf("expected an exact match on the searchable field, got %v", len(items))
+	}
+
+	// Values of the other fields are only encrypted for partial updates
+	secret, err := ds.EncryptedValue(ctx, "notes.text", "patched-secret")
+	if err != nil {
+		t.Fatalf("unexpected error encrypting: %v", err)
+	}
+	err = ds.Patch(ctx, "enc-1", map[string]interface{}{
+		"notes": []map[string]interface{}{{"text": secret}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error patching: %v", err)
+	}
+	item, err = ds.Get(ctx, "enc-1")
+	if err != nil || item.Notes[0].Text != "patched-secret" {
+		t.Fatalf("expected the patched value to be decrypted, got %+v: %v", item, err)
+	}
+	_, err = ds.EncryptedValue(ctx, "id", "enc-1")
+	if err == nil {
+		t.Fatalf("expected fields that are not encrypted to be refused")
+	}
+}
+
+func TestAESGCMEncryptor(t *testing.T) {
+	ctx := context.Background()
+	key := []byte("0123456789abcdef0123456789abcdef")
+	encryptor := NewAESGCMEncryptor(NewStaticKeyProvider("k1", map[string][]byte{"k1": key}))
+
+	value, err := encryptor.Encrypt(ctx, "secret", "hunter2", false)
+	if err != nil || !strings.HasPrefix(value, "enc:v2:k1:") {
+		t.Fatalf("unexpected encrypted value %v: %v", value, err)
+	}
+	plaintext, err := encryptor.Decrypt(ctx, "secret", value)
+	if err != nil || plaintext != "hunter2" {
+		t.Fatalf("expected the value to decrypt, got %v: %v", plaintext, err)
+	}
+	if _, err := encryptor.Decrypt(ctx, "other", value); err == nil {
+		t.Fatalf("expected a value moved to another field not to decrypt")
+	}
+	again, _ := encryptor.Encrypt(ctx, "secret", "hunter2", false)
+	if again == value {
+		t.Fatalf("expected random nonces")
+	}
+
+	// Deterministic values only repeat within the same field
+	first, _ := encryptor.Encrypt(ctx, "email", "a@b.c", true)
+	second, _ := encryptor.Encrypt(ctx, "email", "a@b.c", true)
+	other, _ := encryptor.Encrypt(ctx, "backupEmail", "a@b.c", true)
+	if first != second || first == other || !strings.HasPrefix(first, "enc:d2:") {
+		t.Fatalf("expected deterministic values per field, got %v %v %v", first, second, other)
+	}
+
+	_, err = encryptor.Decrypt(ctx, "secret", "hunter2")
+	if !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("expected a plaintext value to be refused, got %v", err)
+	}
+	encryptor.AllowPlaintext = true
+	plaintext, err = encryptor.Decrypt(ctx, "secret", "hunter2")
+	if err != nil || plaintext != "hunter2" {
+		t.Fatalf("expected a plaintext value while migrating, got %v: %v", plaintext, err)
+	}
+
+	// Values of the first format only authenticate the key ID
+	gcm, err := newGCM(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := legacyEncryptedPrefix + "k1:" + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("old"), []byte("k1")))
+	plaintext, err = encryptor.Decrypt(ctx, "secret", legacy)
+	if err != nil || plaintext != "old" {
+		t.Fatalf("expected a legacy value to decrypt, got %v: %v", plaintext, err)
+	}
+
+	_, err = encryptor.Decrypt(ctx, "secret", "enc:v2:k2:AAAA")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected an unknown key, got %v", err)
+	}
+}
+
+type validatedTestItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (item *validatedTestItem) Validate() error {
+	if item.Age < 0 {
+		rtn := &ValidationError{}
+		rtn.Add("age", "must not be negative")
+		return rtn
+	}
+	return nil
+}
+
+func TestJsonDataStoreValidation(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[validatedTestItem](
+		"testvalidation",
+	)
+	ds.Validation = &DocumentValidation{
+		Schema: new(spec.Schema).
+			Typed("object", "").
+			WithRequired("id", "name").
+			SetProperty("name", *spec.StringProperty().WithMinLength(1)),
+		MaxDocumentSize: 1024,
+	}
+
+	ds.Open(ctx, info)
+
+	err := ds.Save(ctx, &validatedTestItem{ID: "val-1", Age: -1}, "val-1")
+	if !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 2 {
+		t.Fatalf("expected the age and name to fail, got %v", err)
+	}
+
+	err = ds.Save(ctx, &validatedTestItem{ID: "val-2", Name: strings.Repeat("x", 2048)}, "val-2")
+	if !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected the document to be too large, got %v", err)
+	}
+
+	_, err = ds.SaveMany(ctx, []*validatedTestItem{
+		{ID: "val-3", Name: "OK"},
+		{ID: "val-4", Age: -1},
+	}, []string{"val-3", "val-4"})
+	if !errors.As(err, &validationErr) || validationErr.ID != "val-4" {
+		t.Fatalf("expected the bulk write to be rejected, got %v", err)
+	}
+
+	err = ds.Save(ctx, &validatedTestItem{ID: "val-5", Name: "OK"}, "val-5")
+	if err != nil {
+		t.Fatalf("unexpected error saving a valid item: %v", err)
+	}
+}
+
+type hookedTestItem struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Display string `json:"-"`
+}
+
+func (item *hookedTestItem) BeforeSave(ctx context.Context) error {
+	item.Name = strings.ToUpper(item.Name)
+	return nil
+}
+
+func (item *hookedTestItem) AfterLoad(ctx context.Context) error {
+	item.Display = "Item " + item.Name
+	return nil
+}
+
+func (item *hookedTestItem) BeforeDelete(ctx context.Context) error {
+	if item.Name == "PINNED" {
+		return errors.New("pinned items cannot be deleted")
+	}
+	return nil
+}
+
+func TestJsonDataStoreHooks(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[hookedTestItem](
+		"testhooks",
+	)
+	ds.Hooks.BeforeDelete = func(ctx context.Context, key string) error {
+		if key == "locked" {
+			return errors.New("locked items cannot be deleted")
+		}
+		return nil
+	}
+
+	ds.Open(ctx, info)
+
+	err := ds.Save(ctx, &hookedTestItem{ID: "hook-1", Name: "first"}, "hook-1")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	item, err := ds.Get(ctx, "hook-1")
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if item.Name != "FIRST" || item.Display != "Item FIRST" {
+		t.Fatalf("expected the hooks to run, got %+v", item)
+	}
+
+	items, err := ds.GetAll(ctx)
+	if err != nil || len(items) == 0 || items[0].Display == "" {
+		t.Fatalf("expected the after load hook to run on GetAll: %v", err)
+	}
+
+	err = ds.Save(ctx, &hookedTestItem{ID: "locked", Name: "locked"}, "locked")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	err = ds.Delete(ctx, "locked")
+	if err == nil {
+		t.Fatalf("expected the delete to be aborted")
+	}
+	if _, err := ds.MustGet(ctx, "locked"); err != nil {
+		t.Fatalf("expected the item to still exist: %v", err)
+	}
+
+	err = ds.Save(ctx, &hookedTestItem{ID: "pinned", Name: "pinned"}, "pinned")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	_, err = ds.DeleteMany(ctx, []string{"hook-1", "pinned"})
+	if err == nil {
+		t.Fatalf("expected the model hook to abort the delete")
+	}
+	if _, err := ds.MustGet(ctx, "pinned"); err != nil {
+		t.Fatalf("expected the item to still exist: %v", err)
+	}
+}
+
+type guardedTestItem struct {
+	ID    string
+	Guard *testGuard
+}
+
+type testGuard struct {
+	Pinned bool
+}
+
+func (item *guardedTestItem) BeforeDelete(ctx context.Context) error {
+	if item.Guard != nil && item.Guard.Pinned {
+		return errors.New("pinned items cannot be deleted")
+	}
+	return nil
+}
+
+func TestJsonDataStoreBeforeDeleter(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[guardedTestItem](
+		"testbeforedeleter",
+	)
+
+	ds.Open(ctx, info)
+
+	pinned := &guardedTestItem{ID: "guard-1", Guard: &testGuard{Pinned: true}}
+	free := &guardedTestItem{ID: "guard-2", Guard: &testGuard{}}
+	_, err := ds.SaveMany(ctx, []*guardedTestItem{pinned, free}, []string{pinned.ID, free.ID})
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// The hook runs on the stored item, not on what the caller has
+	pinned.Guard.Pinned = false
+	err = ds.Delete(ctx, pinned.ID)
+	if err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Fatalf("expected the hook to abort the delete, got %v", err)
+	}
+	if _, err := ds.MustGet(ctx, pinned.ID); err != nil {
+		t.Fatalf("expected the pinned item to still exist: %v", err)
+	}
+
+	err = ds.Delete(ctx, free.ID)
+	if err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	if exists, _ := ds.Exists(ctx, free.ID); exists {
+		t.Fatalf("expected the item to be deleted")
+	}
+
+	// Items that do not exist are skipped
+	err = ds.Delete(ctx, "guard-missing")
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error deleting a missing item: %v", err)
+	}
+
+	err = ds.Save(ctx, pinned, pinned.ID)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	err = ds.Delete(ctx, pinned.ID)
+	if err != nil {
+		t.Fatalf("expected the unpinned item to be deleted, got %v", err)
+	}
+}
+
+type stampedTestItem struct {
+	ID        string     `json:"id" elastic:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"createdAt" elastic:"createdAt"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty" elastic:"updatedAt"`
+}
+
+func TestJsonDataStoreAdd(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[stampedTestItem](
+		"testadd",
+	)
+
+	ds.Open(ctx, info)
+
+	item := &stampedTestItem{Name: "SERVER"}
+	key, err := ds.Add(ctx, item)
+	if err != nil {
+		t.Fatalf("unexpected error adding: %v", err)
+	}
+	if key == "" || item.ID != key {
+		t.Fatalf("expected Elastic Search to assign the key, got %v", key)
+	}
+	if item.CreatedAt.IsZero() || item.UpdatedAt == nil {
+		t.Fatalf("expected the timestamps to be set, got %+v", item)
+	}
+	created := item.CreatedAt
+
+	loaded, err := ds.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected error loading: %v", err)
+	}
+	if loaded.ID != key {
+		t.Fatalf("expected the assigned key to be stored, got %v", loaded.ID)
+	}
+	err = ds.Save(ctx, loaded, key)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if !loaded.CreatedAt.Equal(created) || !loaded.UpdatedAt.After(created) {
+		t.Fatalf("expected only the updated time to change, got %+v", loaded)
+	}
+
+	ds.IDGenerator = ULIDGenerator
+	key, err = ds.Add(ctx, &stampedTestItem{Name: "ULID"})
+	if err != nil {
+		t.Fatalf("unexpected error adding: %v", err)
+	}
+	loaded, err = ds.Get(ctx, key)
+	if err != nil || loaded.ID != key {
+		t.Fatalf("expected the generated key to be stored, got %v", err)
+	}
+
+	existing := &stampedTestItem{Name: "DUPLICATE"}
+	err = ds.Create(ctx, existing, key)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	if !existing.CreatedAt.IsZero() || existing.UpdatedAt != nil {
+		t.Fatalf("expected a failed write to leave the item as it was, got %+v", existing)
+	}
+}
+
+type nestedTestItem struct {
+	ID     string
+	Owner  *nestedTestOwner
+	Tags   []string
+	Labels map[string]string
+	Extra  interface{} `json:"-"`
+	secret *nestedTestOwner
+}
+
+type nestedTestOwner struct {
+	Name   string
+	Parent *nestedTestOwner `json:"-"`
+}
+
+func TestCopyItem(t *testing.T) {
+	owner := &nestedTestOwner{Name: "owner"}
+	owner.Parent = owner
+	item := &nestedTestItem{
+		ID:     "copy-1",
+		Owner:  owner,
+		Tags:   []string{"a"},
+		Labels: map[string]string{"k": "v"},
+		Extra:  owner,
+		secret: owner,
+	}
+
+	copied := copyItem(item)
+	if copied.Owner == item.Owner || copied.Owner.Name != "owner" {
+		t.Fatalf("expected the owner to be copied, got %+v", copied.Owner)
+	}
+	if copied.Owner.Parent != copied.Owner || copied.Extra != copied.Owner {
+		t.Fatalf("expected shared pointers and cycles to be kept in the copy")
+	}
+	if copied.secret != owner {
+		t.Fatalf("expected unexported fields to be copied as they are")
+	}
+
+	copied.Owner.Name = "changed"
+	copied.Tags[0] = "changed"
+	copied.Labels["k"] = "changed"
+	if owner.Name != "owner" || item.Tags[0] != "a" || item.Labels["k"] != "v" {
+		t.Fatalf("expected the item to be left as it was, got %+v", item)
+	}
+	if copyItem[nestedTestItem](nil) != nil {
+		t.Fatalf("expected no copy of a nil item")
+	}
+}
+
+func TestJsonDataStoreFailedWrite(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[nestedTestItem](
+		"testfailedwrite",
+	)
+	ds.Hooks.BeforeSave = func(ctx context.Context, key string, item *nestedTestItem) error {
+		item.Owner.Name = strings.ToUpper(item.Owner.Name)
+		item.Tags[0] = "saved"
+		item.Labels["state"] = "saved"
+		return nil
+	}
+
+	ds.Open(ctx, info)
+
+	saved := &nestedTestItem{ID: "nested-1", Owner: &nestedTestOwner{Name: "first"}, Tags: []string{"new"}, Labels: map[string]string{}}
+	err := ds.Save(ctx, saved, saved.ID)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	if saved.Owner.Name != "FIRST" || saved.Tags[0] != "saved" || saved.Labels["state"] != "saved" {
+		t.Fatalf("expected a successful write to update the item, got %+v", saved)
+	}
+
+	owner := &nestedTestOwner{Name: "second"}
+	duplicate := &nestedTestItem{ID: "nested-1", Owner: owner, Tags: []string{"new"}, Labels: map[string]string{}}
+	err = ds.Create(ctx, duplicate, duplicate.ID)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	if duplicate.Owner != owner || owner.Name != "second" || duplicate.Tags[0] != "new" || len(duplicate.Labels) != 0 {
+		t.Fatalf("expected a failed write to leave the nested values as they were, got %+v %+v", duplicate, owner)
+	}
+	ds.Delete(ctx, saved.ID)
+}
+
+func TestJsonDataStoreSearch(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testsearch",
+	)
+	ds.SoftDelete = true
+
+	ds.Open(ctx, info)
+
+	ds.Save(ctx, &datastore.TestItem{ID: "search-1", Name: "FIRST"}, "search-1")
+	ds.Save(ctx, &datastore.TestItem{ID: "search-2", Name: "SECOND"}, "search-2")
+	ds.Delete(ctx, "search-2")
+
+	q := NewQuery()
+	q.Query.MatchAll = true
+	res, err := ds.Search(ctx, q)
+	if err != nil {
+		t.Fatalf("unexpected error searching: %v", err)
+	}
+	if res.Total() != 1 || res.Hits.Total.Relation != "eq" {
+		t.Fatalf("expected a single visible item, got %v", res.Total())
+	}
+	hit := res.First()
+	if hit.ID != "search-1" || hit.Source == nil || hit.Source.Name != "FIRST" {
+		t.Fatalf("unexpected hit %+v", hit)
+	}
+}
+
+type routedTestItem struct {
+	ID     string
+	Tenant string
+	Name   string
+}
+
+func TestJsonDataStoreRouting(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[routedTestItem](
+		"testrouting",
+	)
+	ds.ItemRoutingFunc = func(item *routedTestItem) string {
+		return item.Tenant
+	}
+
+	ds.Open(ctx, info)
+
+	err := ds.Save(ctx, &routedTestItem{ID: "route-1", Tenant: "acme", Name: "FIRST"}, "route-1")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	_, err = ds.SaveMany(ctx, []*routedTestItem{{ID: "route-2", Tenant: "globex", Name: "SECOND"}}, []string{"route-2"})
+	if err != nil {
+		t.Fatalf("unexpected error saving many: %v", err)
+	}
+
+	q := NewQuery()
+	q.Query.MatchAll = true
+	res, err := ds.Search(ctx, q)
+	if err != nil {
+		t.Fatalf("unexpected error searching: %v", err)
+	}
+	routings := make(map[string]string)
+	for _, hit := range res.Hits.Hits {
+		routings[hit.ID] = hit.Routing
+	}
+	if routings["route-1"] != "acme" || routings["route-2"] != "globex" {
+		t.Fatalf("expected the items to be routed by tenant, got %v", routings)
+	}
+
+	// Reads have no item, the routing is given per call
+	item, err := ds.Get(WithRouting(ctx, "acme"), "route-1")
+	if err != nil || item == nil || item.Name != "FIRST" {
+		t.Fatalf("expected the routed item, got %v: %v", item, err)
+	}
+	found, err := ds.GetMany(WithRouting(ctx, "globex"), []string{"route-2"})
+	if err != nil || !found[0].Found {
+		t.Fatalf("expected the routed item, got %v", err)
+	}
+	err = ds.Delete(WithRouting(ctx, "acme"), "route-1")
+	if err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+
+	// The key based routing is used by reads as well
+	keyed := NewElasticJsonDataStore[routedTestItem](
+		"testrouting",
+	)
+	keyed.RoutingFunc = func(key string) string {
+		return strings.SplitN(key, ":", 2)[0]
+	}
+	keyed.Open(ctx, info)
+
+	err = keyed.Save(ctx, &routedTestItem{ID: "initech:3", Name: "THIRD"}, "initech:3")
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	item, err = keyed.Get(ctx, "initech:3")
+	if err != nil || item == nil || item.Name != "THIRD" {
+		t.Fatalf("expected the key routed item, got %v: %v", item, err)
+	}
+	err = keyed.Patch(ctx, "initech:3", map[string]interface{}{"Name": "PATCHED"})
+	if err != nil {
+		t.Fatalf("unexpected error patching: %v", err)
+	}
+	err = keyed.Delete(ctx, "initech:3")
+	if err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+}
+
+func TestElasticErrors(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	client, err := NewClient(info)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+
+	_, err = QueryWithOptions(ctx, client, "testmissingindex", NewQuery().Build(), nil)
+	if !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the index to be missing, got %v", err)
+	}
+	var elasticErr *ElasticError
+	if !errors.As(err, &elasticErr) || elasticErr.Status != 404 || elasticErr.Index != "testmissingindex" {
+		t.Fatalf("expected an elastic error, got %v", err)
+	}
+
+	err = CreateIndex(client, "testerrors")
+	if err != nil {
+		t.Fatalf("unexpected error creating the index: %v", err)
+	}
+	_, err = GetDocument(ctx, client, "missing", "testerrors", nil)
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the document to be missing, got %v", err)
+	}
+
+	_, err = QueryWithOptions(ctx, client, "testerrors", `{"query":{"bogus":{}}}`, nil)
+	if !errors.As(err, &elasticErr) || elasticErr.Status != 400 || elasticErr.Type == "" {
+		t.Fatalf("expected a parsing error, got %v", err)
+	}
+}
+
+func TestJsonDataStoreIterate(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testiterate",
+	)
+	ds.Bulk = &BulkOptions{BatchSize: 5000, Refresh: RefreshImmediate}
+
+	ds.Open(ctx, info)
+
+	count := 12000
+	items := make([]*datastore.TestItem, count)
+	keys := make([]string, count)
+	for i := range items {
+		keys[i] = fmt.Sprintf("iterate-%05d", i)
+		items[i] = &datastore.TestItem{ID: keys[i], Name: "ITEM"}
+	}
+	result, err := ds.SaveMany(ctx, items, keys)
+	if err != nil || result.HasErrors() {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	all, err := ds.GetAll(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error loading all: %v", err)
+	}
+	if len(all) != count {
+		t.Fatalf("expected %v items, got %v", count, len(all))
+	}
+
+	q := NewQuery()
+	q.Query.MatchAll = true
+	q.AddSort("ID.keyword", "desc")
+	cursor, err := OpenCursor[datastore.TestItem](ctx, ds.Client, ds.Index, q, &CursorOptions{PageSize: 500})
+	if err != nil {
+		t.Fatalf("unexpected error opening the cursor: %v", err)
+	}
+	defer cursor.Close()
+	seen := 0
+	previous := ""
+	for cursor.Next() {
+		item := cursor.Value()
+		if previous != "" && item.ID >= previous {
+			t.Fatalf("expected the items in descending order, got %v after %v", item.ID, previous)
+		}
+		previous = item.ID
+		seen++
+	}
+	if cursor.Err() != nil || seen != count {
+		t.Fatalf("expected %v items, got %v: %v", count, seen, cursor.Err())
+	}
+}
+
+func TestJsonDataStoreScroll(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testscroll",
+	)
+	ds.Bulk = &BulkOptions{Refresh: RefreshImmediate}
+
+	ds.Open(ctx, info)
+
+	count := 250
+	items := make([]*datastore.TestItem, count)
+	keys := make([]string, count)
+	for i := range items {
+		keys[i] = fmt.Sprintf("scroll-%03d", i)
+		name := "export"
+		if i%5 == 0 {
+			name = "skip"
+		}
+		items[i] = &datastore.TestItem{ID: keys[i], Name: name}
+	}
+	_, err := ds.SaveMany(ctx, items, keys)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	query := datastore.NewQuery()
+	query.Conditions.Equals("Name", "export")
+
+	exported := 0
+	err = ds.Scroll(ctx, query, &ScrollOptions{BatchSize: 30}, func(key string, item *datastore.TestItem) error {
+		if item.Name != "export" || key != item.ID {
+			return fmt.Errorf("unexpected item %v", key)
+		}
+		exported++
+		return nil
+	})
+	if err != nil || exported != 200 {
+		t.Fatalf("expected 200 exported items, got %v: %v", exported, err)
+	}
+
+	hits, errs := ds.ScrollChannel(ctx, query, &ScrollOptions{BatchSize: 50})
+	received := 0
+	for range hits {
+		received++
+	}
+	if err := <-errs; err != nil || received != 200 {
+		t.Fatalf("expected 200 streamed items, got %v: %v", received, err)
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		number string
+		ok     bool
+	}{
+		{"7.15.0", true},
+		{"7.17.9", true},
+		{"8.0.0-SNAPSHOT", true},
+		{"7.14.2", false},
+		{"6.8.23", false},
+	}
+	for _, test := range tests {
+		ok, err := versionAtLeast(test.number, 7, 15)
+		if err != nil || ok != test.ok {
+			t.Errorf("expected %v to be at least 7.15: %v, got %v: %v", test.number, test.ok, ok, err)
+		}
+	}
+	if _, err := versionAtLeast("seven", 7, 15); err == nil {
+		t.Fatalf("expected an invalid version number to fail")
+	}
+}
+
+func TestJsonDataStoreSlicedExport(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testslicedexport",
+	)
+	ds.Bulk = &BulkOptions{Refresh: RefreshImmediate}
+
+	ds.Open(ctx, info)
+
+	count := 3000
+	items := make([]*datastore.TestItem, count)
+	keys := make([]string, count)
+	for i := range items {
+		keys[i] = fmt.Sprintf("sliced-%05d", i)
+		items[i] = &datastore.TestItem{ID: keys[i], Name: "EXPORT"}
+	}
+	_, err := ds.SaveMany(ctx, items, keys)
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	// Stop the export part way through, then resume it
+	var lock sync.Mutex
+	seen := make(map[string]bool)
+	stop := errors.New("stop")
+	state, err := ds.SlicedExport(ctx, nil, &SlicedExportOptions{Slices: 3, PageSize: 200}, func(key string, item *datastore.TestItem) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(seen) >= 1000 {
+			return stop
+		}
+		seen[key] = true
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("expected the export to stop, got %v", err)
+	}
+	if state.PitID == "" {
+		t.Fatalf("expected the interrupted export to keep its point in time")
+	}
+	stopped := state
+
+	var progress ExportProgress
+	state, err = ds.SlicedExport(ctx, nil, &SlicedExportOptions{
+		State:    stopped,
+		PageSize: 200,
+		OnProgress: func(p ExportProgress) {
+			progress = p
+		},
+	}, func(key string, item *datastore.TestItem) error {
+		lock.Lock()
+		defer lock.Unlock()
+		seen[key] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error resuming: %v", err)
+	}
+	if len(seen) != count || progress.SlicesDone != 3 || progress.Total != int64(count) {
+		t.Fatalf("expected all %v items exported, got %v (%+v)", count, len(seen), progress)
+	}
+	if state.Progress().Exported < int64(count) {
+		t.Fatalf("expected the state to count every item, got %+v", state.Progress())
+	}
+	if state.PitID != "" {
+		t.Fatalf("expected the point in time to be closed once done")
+	}
+
+	// The point in time is gone and the default sort cannot resume without it
+	_, err = ds.SlicedExport(ctx, nil, &SlicedExportOptions{State: stopped}, func(key string, item *datastore.TestItem) error {
+		return nil
+	})
+	if !errors.Is(err, ErrExportExpired) {
+		t.Fatalf("expected ErrExportExpired, got %v", err)
+	}
+}
+
+func TestJsonDataStoreCount(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testcount",
+	)
+	ds.SoftDelete = true
+
+	ds.Open(ctx, info)
+
+	items := []*datastore.TestItem{
+		{ID: "count-1", Name: "red"},
+		{ID: "count-2", Name: "red"},
+		{ID: "count-3", Name: "blue"},
+	}
+	_, err := ds.SaveMany(ctx, items, []string{"count-1", "count-2", "count-3"})
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+	ds.Delete(ctx, "count-2")
+
+	total, err := ds.Count(ctx, nil)
+	if err != nil || total != 2 {
+		t.Fatalf("expected 2 visible items, got %v: %v", total, err)
+	}
+
+	query := datastore.NewQuery()
+	query.Conditions.Equals("Name", "red")
+	red, err := ds.Count(ctx, query)
+	if err != nil || red != 1 {
+		t.Fatalf("expected 1 red item, got %v: %v", red, err)
+	}
+
+	all, err := CountDocuments(ctx, ds.Client, ds.Index, nil, nil)
+	if err != nil || all != 3 {
+		t.Fatalf("expected 3 documents, got %v: %v", all, err)
+	}
+}
+
+func TestJsonDataStoreHighlight(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[datastore.TestItem](
+		"testhighlight",
+	)
+
+	ds.Open(ctx, info)
+
+	ds.Save(ctx, &datastore.TestItem{ID: "hl-1", Name: "quick brown fox"}, "hl-1")
+
+	fragments := 1
+	q := NewQuery()
+	q.Query.Match("Name", "brown")
+	q.Highlight = &Highlight{
+		FragmentSize:      50,
+		NumberOfFragments: &fragments,
+		PreTags:           []string{"<b>"},
+		PostTags:          []string{"</b>"},
+	}
+	q.AddHighlight("Name").Type = "plain"
+
+	res, err := ds.Search(ctx, q)
+	if err != nil {
+		t.Fatalf("unexpected error searching: %v", err)
+	}
+	hit := res.First()
+	if hit == nil {
+		t.Fatalf("expected a hit")
+	}
+	highlighted := hit.Fragments("Name")
+	if len(highlighted) != 1 || !strings.Contains(highlighted[0], "<b>brown</b>") {
+		t.Fatalf("expected the match to be highlighted, got %v", highlighted)
+	}
+}
+
+type aggregatedTestItem struct {
+	ID    string
+	Owner string
+	Size  int
+}
+
+func TestJsonDataStoreAggregate(t *testing.T) {
+	requireElastic(t)
+	ctx := cloudy.StartContext()
+
+	ds := NewElasticJsonDataStore[aggregatedTestItem](
+		"testaggregate",
+	)
+
+	ds.Open(ctx, info)
+
+	items := []*aggregatedTestItem{
+		{ID: "agg-1", Owner: "alice", Size: 10},
+		{ID: "agg-2", Owner: "alice", Size: 30},
+		{ID: "agg-3", Owner: "bob", Size: 50},
+	}
+	_, err := ds.SaveMany(ctx, items, []string{"agg-1", "agg-2", "agg-3"})
+	if err != nil {
+		t.Fatalf("unexpected error saving: %v", err)
+	}
+
+	byOwner := NewTermsAggregation("Owner.keyword")
+	byOwner.AddAggregation("avg_size", NewMetricAggregation(MetricAvg, "Size"))
+
+	sizes := NewRangeAggregation("Size")
+	sizes.AddRange("small", nil, 20)
+	sizes.AddRange("large", 20, nil)
+
+	filters := NewFiltersAggregation()
+	filters.AddFilter("bob").Match("Owner", "bob")
+
+	results, err := ds.Aggregate(ctx, nil, Aggregations{
+		"by_owner": byOwner,
+		"sizes":    sizes,
+		"filters":  filters,
+		"owners":   NewCardinalityAggregation("Owner.keyword"),
+		"stats":    NewMetricAggregation(MetricStats, "Size"),
+		"median":   NewPercentilesAggregation("Size", 50),
+		"per_20":   NewHistogramAggregation("Size", 20),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error aggregating: %v", err)
+	}
+
+	owners, err := results.Buckets("by_owner")
+	if err != nil {
+		t.Fatalf("unexpected error reading the terms: %v", err)
+	}
+	alice := owners.Bucket("alice")
+	if alice == nil || alice.DocCount != 2 {
+		t.Fatalf("expected 2 items for alice, got %v", alice)
+	}
+	avg, err := alice.Aggregations.Value("avg_size")
+	if err != nil || avg.Value == nil || *avg.Value != 20 {
+		t.Fatalf("expected an average size of 20 for alice, got %v: %v", avg, err)
+	}
+
+	ranges, err := results.Buckets("sizes")
+	if err != nil {
+		t.Fatalf("unexpected error reading the range buckets: %v", err)
+	}
+	small, large := ranges.Bucket("small"), ranges.Bucket("large")
+	if small == nil || large == nil || small.DocCount != 1 || large.DocCount != 2 {
+		t.Fatalf("unexpected range buckets %v", ranges)
+	}
+
+	filtered, err := results.Buckets("filters")
+	if err != nil {
+		t.Fatalf("unexpected error reading the filter buckets: %v", err)
+	}
+	if bob := filtered.Bucket("bob"); bob == nil || bob.DocCount != 1 {
+		t.Fatalf("unexpected filter buckets %v", filtered)
+	}
+
+	histogram, err := results.Buckets("per_20")
+	if err != nil || len(histogram.Buckets) != 3 {
+		t.Fatalf("expected 3 histogram buckets, got %v: %v", histogram, err)
+	}
+
+	cardinality, err := results.Value("owners")
+	if err != nil || cardinality.Value == nil || *cardinality.Value != 2 {
+		t.Fatalf("expected 2 owners, got %v: %v", cardinality, err)
+	}
+
+	stats, err := results.Stats("stats")
+	if err != nil || stats.Count != 3 || stats.Sum != 90 || *stats.Max != 50 {
+		t.Fatalf("unexpected stats %v: %v", stats, err)
+	}
+
+	median, err := results.Percentiles("median")
+	if err != nil || median.Percentile(50) == nil {
+		t.Fatalf("expected the median, got %v: %v", median, err)
+	}
+
+	_, err = results.Buckets("missing")
+	if !errors.Is(err, ErrAggregationNotFound) {
+		t.Fatalf("expected ErrAggregationNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package cloudyelastic
+
+import "context"
+
+// RefreshPolicy controls when a write becomes visible to searches
+type RefreshPolicy string
+
+const (
+	// Do not refresh, the write becomes visible with the next periodic refresh
+	RefreshNone RefreshPolicy = "false"
+	// Wait for the next periodic refresh before returning
+	RefreshWaitFor RefreshPolicy = "wait_for"
+	// Refresh the affected shards immediately
+	RefreshImmediate RefreshPolicy = "true"
+)
+
+const (
+	// The write succeeds if the version is higher than the stored version
+	VersionTypeExternal = "external"
+	// The write succeeds if the version is higher than or equal to the stored version
+	VersionTypeExternalGTE = "external_gte"
+)
+
+// WriteOptions are the optional parameters of a document write
+type WriteOptions struct {
+	Refresh       RefreshPolicy
+	IfSeqNo       *int
+	IfPrimaryTerm *int
+	// Set to "create" for insert-only writes
+	OpType string
+	// Only used by updates
+	RetryOnConflict *int
+	Routing         string
+	// Version from an external source of truth, used with VersionType
+	// external or external_gte so older versions never overwrite newer ones
+	Version     *int64
+	VersionType string
+}
+
+func (opts *WriteOptions) isExternallyVersioned() bool {
+	return opts.Version != nil && (opts.VersionType == VersionTypeExternal || opts.VersionType == VersionTypeExternalGTE)
+}
+
+// SearchOptions are the optional parameters of a search
+type SearchOptions struct {
+	Routing string
+}
+
+type writeOptionsKey struct{}
+type routingKey struct{}
+
+// WithWriteOptions returns a context that overrides the write options of
+// ElasticJsonDataStore and ESIndexer for every call made with it. Only the
+// options that are set override the configured ones. IfSeqNo, IfPrimaryTerm
+// and OpType only hold for a single document and are ignored here, use
+// SaveIfMatch or Create instead.
+func WithWriteOptions(ctx context.Context, opts *WriteOptions) context.Context {
+	return context.WithValue(ctx, writeOptionsKey{}, opts)
+}
+
+// WithRefresh returns a context that overrides the refresh policy of
+// ElasticJsonDataStore and ESIndexer for every call made with it
+func WithRefresh(ctx context.Context, policy RefreshPolicy) context.Context {
+	opts := writeOptionsFromContext(ctx)
+	opts.Refresh = policy
+	return WithWriteOptions(ctx, opts)
+}
+
+// WithRouting returns a context that routes every read, write and search of
+// ElasticJsonDataStore and ESIndexer made with it to the given shard key
+func WithRouting(ctx context.Context, routing string) context.Context {
+	return context.WithValue(ctx, routingKey{}, routing)
+}
+
+func routingFromContext(ctx context.Context) string {
+	routing, _ := ctx.Value(routingKey{}).(string)
+	return routing
+}
+
+// WithExternalVersion returns a context that writes documents of
+// ElasticJsonDataStore and ESIndexer made with it using the external version
+func WithExternalVersion(ctx context.Context, version int64, versionType string) context.Context {
+	opts := writeOptionsFromContext(ctx)
+	opts.Version = &version
+	opts.VersionType = versionType
+	return WithWriteOptions(ctx, opts)
+}
+
+// writeOptionsFromContext returns a copy of the write options in the
+// context, or empty options when there are none. The single document
+// conditions are dropped so they never apply to every write of the context
+func writeOptionsFromContext(ctx context.Context) *WriteOptions {
+	rtn := &WriteOptions{}
+	if opts, ok := ctx.Value(writeOptionsKey{}).(*WriteOptions); ok && opts != nil {
+		*rtn = *opts
+	}
+	rtn.IfSeqNo = nil
+	rtn.IfPrimaryTerm = nil
+	rtn.OpType = ""
+	return rtn
+}
+
+// resolveWriteOptions merges the write options in the context with the
+// configured refresh policy
+func resolveWriteOptions(ctx context.Context, refresh RefreshPolicy) *WriteOptions {
+	opts := writeOptionsFromContext(ctx)
+	if opts.Refresh == "" {
+		opts.Refresh = refresh
+	}
+	if opts.Refresh == "" {
+		opts.Refresh = RefreshImmediate
+	}
+	if opts.Routing == "" {
+		opts.Routing = routingFromContext(ctx)
+	}
+	return opts
+}
@@ -0,0 +1,200 @@
+package cloudyelastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ScrollOptions are the optional parameters of a scroll
+type ScrollOptions struct {
+	// Number of documents loaded per request. Defaults to 1000
+	BatchSize int
+	// How long the scroll is kept between two batches. Defaults to a minute
+	KeepAlive time.Duration
+	Routing   string
+}
+
+func (opts *ScrollOptions) withDefaults() *ScrollOptions {
+	rtn := &ScrollOptions{}
+	if opts != nil {
+		*rtn = *opts
+	}
+	if rtn.BatchSize <= 0 {
+		rtn.BatchSize = 1000
+	}
+	if rtn.KeepAlive <= 0 {
+		rtn.KeepAlive = time.Minute
+	}
+	return rtn
+}
+
+// Scroll streams every document matching the query to the callback, one
+// batch in memory at a time. Returning an error from the callback, or
+// cancelling the context, stops the scroll. The scroll is always cleared
+// once done. Without a sort in the query the documents come in index order,
+// which is the most efficient
+func Scroll[T any](ctx context.Context, client *elasticsearch.Client, indexName string, query *ElasticSearchQueryBuilder, opts *ScrollOptions, fn func(hit *SearchHit[T]) error) error {
+	if query == nil {
+		query = NewQuery()
+	}
+	return scroll(ctx, client, indexName, query.BuildContainer(), opts, DecodeSearchResponse[T], fn)
+}
+
+// ScrollChannel streams every document matching the query through the
+// returned channel, which is closed at the end. The error channel then
+// receives the error that stopped the scroll, if any. Cancel the context
+// to stop reading early, otherwise the scroll blocks until the channel is
+// drained
+func ScrollChannel[T any](ctx context.Context, client *elasticsearch.Client, indexName string, query *ElasticSearchQueryBuilder, opts *ScrollOptions) (<-chan *SearchHit[T], <-chan error) {
+	return scrollChannel(ctx, opts, func(fn func(hit *SearchHit[T]) error) error {
+		return Scroll(ctx, client, indexName, query, opts, fn)
+	})
+}
+
+func scrollChannel[T any](ctx context.Context, opts *ScrollOptions, run func(fn func(hit *SearchHit[T]) error) error) (<-chan *SearchHit[T], <-chan error) {
+	hits := make(chan *SearchHit[T], opts.withDefaults().BatchSize)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(hits)
+		err := run(func(hit *SearchHit[T]) error {
+			select {
+			case hits <- hit:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return hits, errs
+}
+
+func scroll[T any](ctx context.Context, client *elasticsearch.Client, indexName string, body *gabs.Container, opts *ScrollOptions, decode func(data []byte) (*SearchResponse[T], error), fn func(hit *SearchHit[T]) error) error {
+	opts = opts.withDefaults()
+
+	scrollBody := gabs.New()
+	if query := body.S("query"); query != nil {
+		scrollBody.Set(query.Data(), "query")
+	}
+	if source := body.S("_source"); source != nil {
+		scrollBody.Set(source.Data(), "_source")
+	}
+	if highlight := body.S("highlight"); highlight != nil {
+		scrollBody.Set(highlight.Data(), "highlight")
+	}
+	if sort := body.S("sort"); sort != nil {
+		scrollBody.Set(sort.Data(), "sort")
+	} else {
+		scrollBody.Set([]string{"_doc"}, "sort")
+	}
+	scrollBody.Set(opts.BatchSize, "size")
+
+	req := esapi.SearchRequest{
+		Index:  []string{indexName},
+		Body:   bytes.NewReader(scrollBody.Bytes()),
+		Scroll: opts.KeepAlive,
+	}
+	if opts.Routing != "" {
+		req.Routing = []string{opts.Routing}
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return fmt.Errorf("error getting response: %s", err)
+	}
+
+	var scrollID string
+	defer func() {
+		clearScroll(client, scrollID)
+	}()
+
+	for {
+		page, pageScrollID, err := readScrollPage(res, indexName, decode)
+		if pageScrollID != "" {
+			scrollID = pageScrollID
+		}
+		if err != nil {
+			return err
+		}
+		if len(page.Hits.Hits) == 0 {
+			return nil
+		}
+
+		for _, hit := range page.Hits.Hits {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(hit); err != nil {
+				return err
+			}
+		}
+
+		next, err := json.Marshal(map[string]string{
+			"scroll":    fmt.Sprintf("%dms", opts.KeepAlive.Milliseconds()),
+			"scroll_id": scrollID,
+		})
+		if err != nil {
+			return err
+		}
+		scrollReq := esapi.ScrollRequest{
+			Body: bytes.NewReader(next),
+		}
+		res, err = scrollReq.Do(ctx, client)
+		if err != nil {
+			return fmt.Errorf("error getting response: %s", err)
+		}
+	}
+}
+
+// readScrollPage decodes a batch of the scroll. The scroll ID is returned
+// even when the documents cannot be decoded, so the scroll can be cleared
+func readScrollPage[T any](res *esapi.Response, indexName string, decode func(data []byte) (*SearchResponse[T], error)) (*SearchResponse[T], string, error) {
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, "", responseError(res, indexName, "")
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var scrollID struct {
+		ID string `json:"_scroll_id"`
+	}
+	if err := json.Unmarshal(data, &scrollID); err != nil {
+		return nil, "", fmt.Errorf("error parsing the response body: %s", err)
+	}
+	page, err := decode(data)
+	return page, scrollID.ID, err
+}
+
+// clearScroll releases the scroll. It uses a fresh context so the scroll is
+// released even when the context was cancelled
+func clearScroll(client *elasticsearch.Client, scrollID string) {
+	if scrollID == "" {
+		return
+	}
+	body, err := json.Marshal(map[string][]string{"scroll_id": {scrollID}})
+	if err != nil {
+		return
+	}
+	req := esapi.ClearScrollRequest{
+		Body: bytes.NewReader(body),
+	}
+	res, err := req.Do(context.Background(), client)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
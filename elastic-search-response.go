@@ -0,0 +1,153 @@
+package cloudyelastic
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// TotalHits is the number of documents matching a search. When Relation is
+// "gte" the value is a lower bound
+type TotalHits struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+// ShardSummary reports how many shards took part in a search
+type ShardSummary struct {
+	Total      int               `json:"total"`
+	Successful int               `json:"successful"`
+	Skipped    int               `json:"skipped"`
+	Failed     int               `json:"failed"`
+	Failures   []json.RawMessage `json:"failures,omitempty"`
+}
+
+// SearchHit is a single document of a search response. Source is nil when
+// the search did not return the source
+type SearchHit[T any] struct {
+	Index       string              `json:"_index"`
+	ID          string              `json:"_id"`
+	Score       *float64            `json:"_score"`
+	Version     *int64              `json:"_version,omitempty"`
+	SeqNo       *int64              `json:"_seq_no,omitempty"`
+	PrimaryTerm *int64              `json:"_primary_term,omitempty"`
+	Routing     string              `json:"_routing,omitempty"`
+	Sort        []interface{}       `json:"sort,omitempty"`
+	Highlight   map[string][]string `json:"highlight,omitempty"`
+	Fields      json.RawMessage     `json:"fields,omitempty"`
+	Source      *T                  `json:"_source,omitempty"`
+}
+
+// Fragments returns the highlighted fragments of the field, nil when the
+// field was not highlighted
+func (h *SearchHit[T]) Fragments(field string) []string {
+	return h.Highlight[field]
+}
+
+// SearchHits are the matching documents of a search response
+type SearchHits[T any] struct {
+	Total    *TotalHits      `json:"total"`
+	MaxScore *float64        `json:"max_score"`
+	Hits     []*SearchHit[T] `json:"hits"`
+}
+
+// SearchResponse is the decoded body of a search response, with the source
+// of the hits decoded as T. Use json.RawMessage to keep the sources as they
+// were returned
+type SearchResponse[T any] struct {
+	Took         int64           `json:"took"`
+	TimedOut     bool            `json:"timed_out"`
+	Shards       ShardSummary    `json:"_shards"`
+	Hits         SearchHits[T]   `json:"hits"`
+	Aggregations json.RawMessage `json:"aggregations,omitempty"`
+	ScrollID     string          `json:"_scroll_id,omitempty"`
+	PitID        string          `json:"pit_id,omitempty"`
+}
+
+// DecodeSearchResponse decodes the body of a search response
+func DecodeSearchResponse[T any](data []byte) (*SearchResponse[T], error) {
+	rtn := &SearchResponse[T]{}
+	if err := json.Unmarshal(data, rtn); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+	return rtn, nil
+}
+
+// ParseSearchResponse decodes a search response returned by Query
+func ParseSearchResponse[T any](results string) (*SearchResponse[T], error) {
+	return DecodeSearchResponse[T]([]byte(results))
+}
+
+// Total returns the number of matching documents, or -1 when the search did
+// not track the total
+func (r *SearchResponse[T]) Total() int64 {
+	if r.Hits.Total == nil {
+		return -1
+	}
+	return r.Hits.Total.Value
+}
+
+// IDs returns the IDs of the hits
+func (r *SearchResponse[T]) IDs() []string {
+	rtn := make([]string, len(r.Hits.Hits))
+	for i, hit := range r.Hits.Hits {
+		rtn[i] = hit.ID
+	}
+	return rtn
+}
+
+// Sources returns the sources of the hits, nil for the hits without source
+func (r *SearchResponse[T]) Sources() []*T {
+	rtn := make([]*T, len(r.Hits.Hits))
+	for i, hit := range r.Hits.Hits {
+		rtn[i] = hit.Source
+	}
+	return rtn
+}
+
+// First returns the first hit, or nil when nothing matched
+func (r *SearchResponse[T]) First() *SearchHit[T] {
+	if len(r.Hits.Hits) == 0 {
+		return nil
+	}
+	return r.Hits.Hits[0]
+}
+
+// convertSearchResponse converts the sources of the hits with the function
+func convertSearchResponse[S any, T any](res *SearchResponse[S], convert func(source *S) (*T, error)) (*SearchResponse[T], error) {
+	rtn := &SearchResponse[T]{
+		Took:         res.Took,
+		TimedOut:     res.TimedOut,
+		Shards:       res.Shards,
+		Aggregations: res.Aggregations,
+		ScrollID:     res.ScrollID,
+		PitID:        res.PitID,
+		Hits: SearchHits[T]{
+			Total:    res.Hits.Total,
+			MaxScore: res.Hits.MaxScore,
+			Hits:     make([]*SearchHit[T], len(res.Hits.Hits)),
+		},
+	}
+	for i, hit := range res.Hits.Hits {
+		converted := &SearchHit[T]{
+			Index:       hit.Index,
+			ID:          hit.ID,
+			Score:       hit.Score,
+			Version:     hit.Version,
+			SeqNo:       hit.SeqNo,
+			PrimaryTerm: hit.PrimaryTerm,
+			Routing:     hit.Routing,
+			Sort:        hit.Sort,
+			Highlight:   hit.Highlight,
+			Fields:      hit.Fields,
+		}
+		if hit.Source != nil {
+			source, err := convert(hit.Source)
+			if err != nil {
+				return nil, err
+			}
+			converted.Source = source
+		}
+		rtn.Hits.Hits[i] = converted
+	}
+	return rtn, nil
+}
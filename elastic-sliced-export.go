@@ -0,0 +1,291 @@
+package cloudyelastic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+// SliceState is the progress of a single slice of an export
+type SliceState struct {
+	ID int `json:"id"`
+	// Sort values of the last exported document, the slice resumes after it
+	SearchAfter []json.RawMessage `json:"searchAfter,omitempty"`
+	Exported    int64             `json:"exported"`
+	// Number of documents in the slice, -1 until the first page is loaded
+	Total int64 `json:"total"`
+	Done  bool  `json:"done"`
+}
+
+// ExportState is the progress of all the slices of an export. It can be
+// persisted, e.g. as JSON, and passed back in SlicedExportOptions.State to
+// resume an interrupted export.
+//
+// The sort values a slice resumes after end with the _shard_doc tiebreaker,
+// which only holds in the point in time that produced them. An interrupted
+// export therefore keeps its point in time open until it expires, and a
+// resume reuses it. Once it expired the export can only resume on a new
+// point in time if the query sorts on a unique field that never changes,
+// e.g. the key as a keyword, otherwise ErrExportExpired is returned. On a
+// new point in time, documents changed in the meantime may be exported or
+// skipped
+type ExportState struct {
+	// Point in time of the export, kept open while it is not done
+	PitID  string        `json:"pitId,omitempty"`
+	Slices []*SliceState `json:"slices"`
+}
+
+func (s *ExportState) copy() *ExportState {
+	rtn := &ExportState{PitID: s.PitID, Slices: make([]*SliceState, len(s.Slices))}
+	for i, slice := range s.Slices {
+		c := *slice
+		rtn.Slices[i] = &c
+	}
+	return rtn
+}
+
+// ExportProgress is the aggregated progress of all the slices of an export
+type ExportProgress struct {
+	Exported   int64
+	Total      int64
+	Slices     int
+	SlicesDone int
+}
+
+// SlicedExportOptions are the optional parameters of a sliced export
+type SlicedExportOptions struct {
+	// Number of slices, each processed by its own worker. Defaults to 4
+	Slices int
+	// Number of documents loaded per request. Defaults to 1000
+	PageSize int
+	// How long the point in time is kept between two pages. Defaults to a minute
+	KeepAlive time.Duration
+	Routing   string
+	// State of an interrupted export to resume
+	State *ExportState
+	// Called with a copy of the state after every page, to persist it
+	OnCheckpoint func(state *ExportState)
+	// Called with the aggregated progress after every page
+	OnProgress func(progress ExportProgress)
+}
+
+// SlicedExport exports every document matching the query by splitting it in
+// slices that are processed concurrently under a single point in time. The
+// callback is called concurrently from the workers, along with the slice
+// of the document, and must be safe for concurrent use. The first error
+// stops all the workers. Slicing a point in time needs Elastic Search 7.15
+// or later, ErrUnsupportedVersion is returned on older clusters.
+//
+// The final state is always returned, so an export that failed or was
+// cancelled can be resumed with it, see ExportState. The documents of the
+// pages that were in progress are exported again when resuming
+func SlicedExport[T any](ctx context.Context, client *elasticsearch.Client, indexName string, query *ElasticSearchQueryBuilder, opts *SlicedExportOptions, fn func(slice int, hit *SearchHit[T]) error) (*ExportState, error) {
+	if query == nil {
+		query = NewQuery()
+	}
+	return slicedExport(ctx, client, indexName, query.BuildContainer(), opts, DecodeSearchResponse[T], fn)
+}
+
+func slicedExport[T any](ctx context.Context, client *elasticsearch.Client, indexName string, body *gabs.Container, opts *SlicedExportOptions, decode func(data []byte) (*SearchResponse[T], error), fn func(slice int, hit *SearchHit[T]) error) (*ExportState, error) {
+	if opts == nil {
+		opts = &SlicedExportOptions{}
+	}
+	slices := opts.Slices
+	if slices <= 0 {
+		slices = 4
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = time.Minute
+	}
+	keepAliveParam := fmt.Sprintf("%dms", keepAlive.Milliseconds())
+
+	state := &ExportState{}
+	if opts.State != nil {
+		state = opts.State.copy()
+		slices = len(state.Slices)
+	} else {
+		for i := 0; i < slices; i++ {
+			state.Slices = append(state.Slices, &SliceState{ID: i, Total: -1})
+		}
+	}
+
+	if slices > 1 {
+		if err := requireVersion(ctx, client, 7, 15, "slicing a point in time"); err != nil {
+			return state, err
+		}
+	}
+
+	sliceBody := cursorBody(body)
+	pitID, err := resumePointInTime(ctx, client, indexName, sliceBody, state, keepAliveParam, opts.Routing)
+	if err != nil {
+		return state, err
+	}
+	state.PitID = pitID
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lock sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+
+	// report records the page of the slice and notifies the listeners
+	report := func(slice *SliceState, exported int64, total int64, searchAfter []json.RawMessage, done bool) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		slice.Exported += exported
+		if total >= 0 {
+			slice.Total = total
+		}
+		if searchAfter != nil {
+			slice.SearchAfter = searchAfter
+		}
+		slice.Done = done
+
+		if opts.OnCheckpoint != nil {
+			opts.OnCheckpoint(state.copy())
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(state.Progress())
+		}
+	}
+
+	for _, slice := range state.Slices {
+		if slice.Done {
+			continue
+		}
+
+		wg.Add(1)
+		go func(slice *SliceState, searchAfter []json.RawMessage, total int64) {
+			defer wg.Done()
+
+			workerBody, err := gabs.ParseJSON(sliceBody.Bytes())
+			if err == nil && slices > 1 {
+				workerBody.Set(slice.ID, "slice", "id")
+				workerBody.Set(slices, "slice", "max")
+			}
+
+			for err == nil {
+				var data []byte
+				data, err = searchPointInTime(ctx, client, workerBody, pitID, keepAliveParam, pageSize, searchAfter, total < 0)
+				if err != nil {
+					break
+				}
+
+				var page *SearchResponse[T]
+				page, err = decode(data)
+				if err != nil {
+					break
+				}
+				for _, hit := range page.Hits.Hits {
+					if err = fn(slice.ID, hit); err != nil {
+						break
+					}
+				}
+				if err != nil {
+					break
+				}
+
+				if total < 0 {
+					total = page.Total()
+				}
+				if len(page.Hits.Hits) > 0 {
+					searchAfter, err = lastSortValues(data)
+					if err != nil {
+						break
+					}
+				}
+				done := len(page.Hits.Hits) < pageSize
+				report(slice, int64(len(page.Hits.Hits)), total, searchAfter, done)
+				if done {
+					return
+				}
+				err = ctx.Err()
+			}
+
+			lock.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			lock.Unlock()
+			cancel()
+		}(slice, slice.SearchAfter, slice.Total)
+	}
+
+	wg.Wait()
+
+	// An interrupted export keeps the point in time to resume on it
+	if state.Progress().SlicesDone == len(state.Slices) {
+		closePointInTime(client, pitID)
+		state.PitID = ""
+	}
+	return state.copy(), firstErr
+}
+
+// resumePointInTime returns the point in time of the state while it is
+// alive, or opens a new one when the position of the slices does not depend
+// on the old one
+func resumePointInTime(ctx context.Context, client *elasticsearch.Client, indexName string, body *gabs.Container, state *ExportState, keepAlive string, routing string) (string, error) {
+	if state.PitID != "" {
+		_, err := searchPointInTime(ctx, client, gabs.New(), state.PitID, keepAlive, 0, nil, false)
+		if err == nil {
+			return state.PitID, nil
+		}
+		var elasticErr *ElasticError
+		if !errors.As(err, &elasticErr) || elasticErr.Status != 404 {
+			return "", err
+		}
+	}
+
+	resuming := false
+	for _, slice := range state.Slices {
+		if slice.SearchAfter != nil {
+			resuming = true
+		}
+	}
+	if resuming && onlyTiebreakerSort(body) {
+		return "", ErrExportExpired
+	}
+	return openPointInTime(ctx, client, indexName, keepAlive, routing)
+}
+
+// onlyTiebreakerSort reports whether the body only sorts on the tiebreaker
+func onlyTiebreakerSort(body *gabs.Container) bool {
+	for _, sort := range body.S("sort").Children() {
+		if !sort.Exists(shardDocTiebreaker) && sort.Data() != shardDocTiebreaker {
+			return false
+		}
+	}
+	return true
+}
+
+// Progress returns the aggregated progress of the slices
+func (s *ExportState) Progress() ExportProgress {
+	rtn := ExportProgress{
+		Slices: len(s.Slices),
+	}
+	for _, slice := range s.Slices {
+		rtn.Exported += slice.Exported
+		if slice.Total >= 0 && rtn.Total >= 0 {
+			rtn.Total += slice.Total
+		} else {
+			rtn.Total = -1
+		}
+		if slice.Done {
+			rtn.SlicesDone++
+		}
+	}
+	return rtn
+}
@@ -0,0 +1,143 @@
+package cloudyelastic
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The struct tag used to configure how the store handles a field, e.g.
+// `elastic:"encrypt,searchable"`
+const elasticTag = "elastic"
+
+// Path element that stands for every element of a slice, array or map
+const pathElements = "*"
+
+// taggedField is a struct field with an elastic tag
+type taggedField struct {
+	// Path of the field in the JSON document
+	Path []string
+	// Index of the field for reflect.Value.FieldByIndex, nil for the fields
+	// of the elements of slices, arrays and maps
+	Index   []int
+	Type    reflect.Type
+	Options map[string]bool
+}
+
+func (f *taggedField) Has(option string) bool {
+	return f.Options[option]
+}
+
+func (f *taggedField) Name() string {
+	return strings.Join(f.Path, ".")
+}
+
+// QueryPath returns the path of the field without the element wildcards, the
+// way queries name the fields of the elements of slices
+func (f *taggedField) QueryPath() string {
+	var path []string
+	for _, element := range f.Path {
+		if element != pathElements {
+			path = append(path, element)
+		}
+	}
+	return strings.Join(path, ".")
+}
+
+// Tagged fields of the types seen so far
+var taggedFieldsCache sync.Map
+
+// taggedFields finds all the fields with an elastic tag in the type,
+// including those of nested structs and of the elements of slices, arrays
+// and maps
+func taggedFields(t reflect.Type) []*taggedField {
+	if cached, ok := taggedFieldsCache.Load(t); ok {
+		return cached.([]*taggedField)
+	}
+	fields := collectTaggedFields(t, nil, []int{}, map[reflect.Type]bool{})
+	taggedFieldsCache.Store(t, fields)
+	return fields
+}
+
+// taggedFieldsWith returns the tagged fields of the type that have the option
+func taggedFieldsWith(t reflect.Type, option string) []*taggedField {
+	var rtn []*taggedField
+	for _, field := range taggedFields(t) {
+		if field.Has(option) {
+			rtn = append(rtn, field)
+		}
+	}
+	return rtn
+}
+
+func collectTaggedFields(t reflect.Type, path []string, index []int, seen map[reflect.Type]bool) []*taggedField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		// The fields of the elements can only be reached by their path
+		return collectTaggedFields(t.Elem(), append(append([]string{}, path...), pathElements), nil, seen)
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	var rtn []*taggedField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, skip := jsonFieldName(field)
+		if skip {
+			continue
+		}
+
+		var fieldIndex []int
+		if index != nil {
+			fieldIndex = append(append([]int{}, index...), i)
+		}
+		fieldPath := path
+		if !field.Anonymous || name != field.Name {
+			fieldPath = append(append([]string{}, path...), name)
+		}
+
+		if tag, ok := field.Tag.Lookup(elasticTag); ok {
+			options := make(map[string]bool)
+			for _, option := range strings.Split(tag, ",") {
+				option = strings.TrimSpace(option)
+				if option != "" {
+					options[option] = true
+				}
+			}
+			rtn = append(rtn, &taggedField{
+				Path:    fieldPath,
+				Index:   fieldIndex,
+				Type:    field.Type,
+				Options: options,
+			})
+			continue
+		}
+
+		rtn = append(rtn, collectTaggedFields(field.Type, fieldPath, fieldIndex, seen)...)
+	}
+	return rtn
+}
+
+// jsonFieldName returns the name of the field in the JSON document, the
+// same way encoding/json determines it
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return field.Name, false
+	}
+	return name, false
+}
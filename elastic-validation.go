@@ -0,0 +1,151 @@
+package cloudyelastic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	oaerrors "github.com/go-openapi/errors"
+	"github.com/go-openapi/spec"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+)
+
+// ErrValidation matches every ValidationError with errors.Is
+var ErrValidation = errors.New("validation failed")
+
+// Validator can be implemented by the stored models to check themselves
+// before they are written. The returned error can be a *ValidationError to
+// report the failing fields individually
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is a single failed check. Field is the path of the field in the
+// JSON document, empty when the check applies to the whole document
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%v: %v", e.Field, e.Message)
+}
+
+// ValidationError lists every check a document failed
+type ValidationError struct {
+	ID     string
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Error()
+	}
+	return fmt.Sprintf("invalid document ID=%v, %v", e.ID, strings.Join(messages, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Add records a failed check
+func (e *ValidationError) Add(field string, message string) {
+	e.Fields = append(e.Fields, &FieldError{Field: field, Message: message})
+}
+
+// DocumentValidation are the checks performed before a document is written
+type DocumentValidation struct {
+	// JSON Schema the documents must conform to
+	Schema *spec.Schema
+	// Maximum size of the stored document in bytes, 0 means no limit
+	MaxDocumentSize int
+}
+
+// ValidateItem runs the Validator of the item, if it implements one
+func ValidateItem(id string, item interface{}) error {
+	rtn := &ValidationError{ID: id}
+	checkItem(rtn, item)
+	return rtn.orNil()
+}
+
+// ValidateDocument checks the JSON document against the schema and the
+// maximum size. All the failing checks are reported in a single
+// ValidationError
+func (v *DocumentValidation) ValidateDocument(id string, data []byte) error {
+	rtn := &ValidationError{ID: id}
+	if err := v.checkSchema(rtn, data); err != nil {
+		return err
+	}
+	v.checkSize(rtn, data)
+	return rtn.orNil()
+}
+
+func (e *ValidationError) orNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func checkItem(rtn *ValidationError, item interface{}) {
+	validator, ok := item.(Validator)
+	if !ok {
+		return
+	}
+	err := validator.Validate()
+	if err == nil {
+		return
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		rtn.Fields = append(rtn.Fields, validationErr.Fields...)
+		return
+	}
+	rtn.Add("", err.Error())
+}
+
+func (v *DocumentValidation) checkSchema(rtn *ValidationError, data []byte) error {
+	if v == nil || v.Schema == nil {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	result := validate.NewSchemaValidator(v.Schema, nil, "", strfmt.Default).Validate(doc)
+	for _, err := range result.Errors {
+		addSchemaError(rtn, err)
+	}
+	return nil
+}
+
+func (v *DocumentValidation) checkSize(rtn *ValidationError, data []byte) {
+	if v == nil || v.MaxDocumentSize <= 0 || len(data) <= v.MaxDocumentSize {
+		return
+	}
+	rtn.Add("", fmt.Sprintf("document size %v exceeds the maximum of %v bytes", len(data), v.MaxDocumentSize))
+}
+
+func addSchemaError(rtn *ValidationError, err error) {
+	var composite *oaerrors.CompositeError
+	if errors.As(err, &composite) {
+		for _, e := range composite.Errors {
+			addSchemaError(rtn, e)
+		}
+		return
+	}
+
+	var validation *oaerrors.Validation
+	if errors.As(err, &validation) {
+		rtn.Add(strings.TrimPrefix(validation.Name, "."), validation.Error())
+		return
+	}
+	rtn.Add("", err.Error())
+}
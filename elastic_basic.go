@@ -1,10 +1,14 @@
 package cloudyelastic
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,9 +18,24 @@ import (
 
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
-	// "github.com/elastic/go-elasticsearch/v7/esutil"
 )
 
+// ErrVersionConflict is returned when a conditional write finds that the
+// document was changed by someone else
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrStaleVersion is returned by externally versioned writes when the
+// stored document already has the same or a newer version. The write was
+// ignored, which is expected when events arrive out of order
+var ErrStaleVersion = errors.New("stale document version")
+
+// ErrNotFound is returned when a document does not exist
+var ErrNotFound = errors.New("document not found")
+
+// ErrAlreadyExists is returned by create-only writes when a document with
+// the same ID is already in the index
+var ErrAlreadyExists = errors.New("document already exists")
+
 // ConnectionInfo connection information
 type ConnectionInfo struct {
 	Endpoint string `json:"endpoint"`
@@ -24,6 +43,38 @@ type ConnectionInfo struct {
 	Password string `json:"password"`
 }
 
+// WriteResult is the response to a document write
+type WriteResult struct {
+	ID          string `json:"_id"`
+	Index       string `json:"_index"`
+	Result      string `json:"result"`
+	Version     int64  `json:"_version"`
+	SeqNo       int    `json:"_seq_no"`
+	PrimaryTerm int    `json:"_primary_term"`
+}
+
+// GetOptions are the optional parameters of a document read
+type GetOptions struct {
+	Routing        string
+	SourceIncludes []string
+	SourceExcludes []string
+	StoredFields   []string
+}
+
+// Document is a single document as returned by the GET API
+type Document struct {
+	ID          string                 `json:"_id"`
+	Index       string                 `json:"_index"`
+	Found       bool                   `json:"found"`
+	Version     int64                  `json:"_version"`
+	SeqNo       int                    `json:"_seq_no"`
+	PrimaryTerm int                    `json:"_primary_term"`
+	Source      json.RawMessage        `json:"_source"`
+	Fields      map[string]interface{} `json:"fields"`
+	// Set by the multi get when this document alone could not be loaded
+	Error *ElasticError `json:"-"`
+}
+
 func NewClientFromEnv(env cloudy.Environment) (*elasticsearch.Client, error) {
 	host := env.Force("ES_HOST")
 	user := env.Force("ES_USER")
@@ -78,6 +129,12 @@ func Index(client *elasticsearch.Client, item interface{}, ID string, indexName
 }
 
 func CreateIndex(client *elasticsearch.Client, indexName string) error {
+	return CreateIndexWithMapping(client, indexName, "")
+}
+
+// CreateIndexWithMapping creates the index, with the settings and mappings
+// in the body, if it does not exist yet
+func CreateIndexWithMapping(client *elasticsearch.Client, indexName string, body string) error {
 	// Set up the request object.
 	req := esapi.IndicesExistsRequest{
 		Index: []string{indexName},
@@ -94,13 +151,16 @@ func CreateIndex(client *elasticsearch.Client, indexName string) error {
 	reqCreate := esapi.IndicesCreateRequest{
 		Index: indexName,
 	}
+	if body != "" {
+		reqCreate.Body = strings.NewReader(body)
+	}
 	res, err = reqCreate.Do(context.Background(), client)
 	if err != nil {
 		return fmt.Errorf("error getting response: %s", err)
 	}
-	if res.StatusCode >= 300 {
-		message, _ := ioutil.ReadAll(res.Body)
-		return fmt.Errorf("error Creating index %v, %v", indexName, string(message))
+	defer res.Body.Close()
+	if res.IsError() {
+		return responseError(res, indexName, "")
 	}
 
 	return nil
@@ -108,94 +168,386 @@ func CreateIndex(client *elasticsearch.Client, indexName string) error {
 
 // Index an item in the elastic search
 func IndexData(client *elasticsearch.Client, data []byte, ID string, indexName string) error {
+	_, err := IndexDataWithOptions(context.Background(), client, data, ID, indexName, &WriteOptions{
+		Refresh: RefreshImmediate,
+	})
+	return err
+}
+
+// IndexDataWithOptions indexes the document and returns the resulting
+// version information. When IfSeqNo and IfPrimaryTerm are set the write only
+// succeeds if the document has not changed, otherwise ErrVersionConflict is
+// returned.
+func IndexDataWithOptions(ctx context.Context, client *elasticsearch.Client, data []byte, ID string, indexName string, opts *WriteOptions) (*WriteResult, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
 	// Set up the request object.
 	req := esapi.IndexRequest{
-		Index:      indexName,
-		DocumentID: ID,
-		Body:       strings.NewReader(string(data)),
-		Refresh:    "true",
+		Index:         indexName,
+		DocumentID:    ID,
+		Body:          bytes.NewReader(data),
+		Refresh:       string(opts.Refresh),
+		IfSeqNo:       opts.IfSeqNo,
+		IfPrimaryTerm: opts.IfPrimaryTerm,
+		OpType:        opts.OpType,
+		Routing:       opts.Routing,
+		VersionType:   opts.VersionType,
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(context.Background(), client)
+	var transport esapi.Transport = client
+	if opts.Version != nil {
+		transport = &versionTransport{Transport: client, version: *opts.Version}
+	}
+	res, err := req.Do(ctx, transport)
 	if err != nil {
-		return fmt.Errorf("error getting response: %s", err)
+		return nil, fmt.Errorf("error getting response: %s", err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return fmt.Errorf("[%s] Error indexing document ID=%v", res.Status(), ID)
+		resErr := responseError(res, indexName, ID)
+		if res.StatusCode == 409 && opts.OpType == "create" {
+			resErr.kind = ErrAlreadyExists
+		} else if res.StatusCode == 409 && opts.isExternallyVersioned() {
+			resErr.kind = ErrStaleVersion
+		}
+		return nil, resErr
 	}
 
-	// Deserialize the response into a map.
-	var r map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		fmt.Printf("Error parsing the response body: %s", err)
-	} else {
-		// Print the response status and indexed document version.
-		fmt.Printf("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
+	result := &WriteResult{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
 	}
 
-	return nil
+	return result, nil
+}
+
+// versionTransport adds the external version to the requests it performs.
+// esapi requests take an *int version, which would truncate int64 versions
+// on 32 bit platforms
+type versionTransport struct {
+	esapi.Transport
+	version int64
+}
+
+func (t *versionTransport) Perform(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	query.Set("version", strconv.FormatInt(t.version, 10))
+	req.URL.RawQuery = query.Encode()
+	return t.Transport.Perform(req)
+}
+
+// Script is a (Painless) script used by scripted updates
+type Script struct {
+	Source string                 `json:"source"`
+	Lang   string                 `json:"lang,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// UpdateBody is the body of an update request. Either Doc or Script should
+// be provided.
+type UpdateBody struct {
+	Doc            interface{} `json:"doc,omitempty"`
+	DocAsUpsert    bool        `json:"doc_as_upsert,omitempty"`
+	Script         *Script     `json:"script,omitempty"`
+	Upsert         interface{} `json:"upsert,omitempty"`
+	ScriptedUpsert bool        `json:"scripted_upsert,omitempty"`
+}
+
+// UpdateData sends the body to the update API for the document
+func UpdateData(ctx context.Context, client *elasticsearch.Client, body *UpdateBody, ID string, indexName string, opts *WriteOptions) (*WriteResult, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req := esapi.UpdateRequest{
+		Index:           indexName,
+		DocumentID:      ID,
+		Body:            bytes.NewReader(data),
+		Refresh:         string(opts.Refresh),
+		IfSeqNo:         opts.IfSeqNo,
+		IfPrimaryTerm:   opts.IfPrimaryTerm,
+		RetryOnConflict: opts.RetryOnConflict,
+		Routing:         opts.Routing,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, responseError(res, indexName, ID)
+	}
+
+	result := &WriteResult{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	return result, nil
+}
+
+// PatchData merges the partial document into the existing document. When
+// upsert is true the partial document is indexed if the document does not
+// exist yet.
+func PatchData(ctx context.Context, client *elasticsearch.Client, partial interface{}, ID string, indexName string, upsert bool, opts *WriteOptions) (*WriteResult, error) {
+	return UpdateData(ctx, client, &UpdateBody{
+		Doc:         partial,
+		DocAsUpsert: upsert,
+	}, ID, indexName, opts)
+}
+
+// ScriptUpdateData runs the script against the document. When upsert is
+// provided it is indexed if the document does not exist yet.
+func ScriptUpdateData(ctx context.Context, client *elasticsearch.Client, script *Script, upsert interface{}, ID string, indexName string, opts *WriteOptions) (*WriteResult, error) {
+	return UpdateData(ctx, client, &UpdateBody{
+		Script: script,
+		Upsert: upsert,
+	}, ID, indexName, opts)
 }
 
 func RemoveData(client *elasticsearch.Client, ID string, indexName string) error {
+	_, err := RemoveDataWithOptions(context.Background(), client, ID, indexName, &WriteOptions{
+		Refresh: RefreshImmediate,
+	})
+	return err
+}
+
+// RemoveDataWithOptions deletes the document
+func RemoveDataWithOptions(ctx context.Context, client *elasticsearch.Client, ID string, indexName string, opts *WriteOptions) (*WriteResult, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
 	// Set up the request object.
 	req := esapi.DeleteRequest{
+		Index:         indexName,
+		DocumentID:    ID,
+		Refresh:       string(opts.Refresh),
+		IfSeqNo:       opts.IfSeqNo,
+		IfPrimaryTerm: opts.IfPrimaryTerm,
+		Routing:       opts.Routing,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, responseError(res, indexName, ID)
+	}
+
+	result := &WriteResult{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	return result, nil
+}
+
+// CreateData indexes the document only if no document with the same ID
+// exists. Otherwise ErrAlreadyExists is returned.
+func CreateData(ctx context.Context, client *elasticsearch.Client, data []byte, ID string, indexName string, opts *WriteOptions) (*WriteResult, error) {
+	createOpts := WriteOptions{}
+	if opts != nil {
+		createOpts = *opts
+	}
+	createOpts.OpType = "create"
+	return IndexDataWithOptions(ctx, client, data, ID, indexName, &createOpts)
+}
+
+// GetDocument loads a document, along with its version information, using
+// the real-time document GET API. ErrNotFound is returned when the document
+// does not exist.
+func GetDocument(ctx context.Context, client *elasticsearch.Client, ID string, indexName string, opts *GetOptions) (*Document, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+
+	req := esapi.GetRequest{
+		Index:          indexName,
+		DocumentID:     ID,
+		Routing:        opts.Routing,
+		SourceIncludes: opts.SourceIncludes,
+		SourceExcludes: opts.SourceExcludes,
+		StoredFields:   opts.StoredFields,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, responseError(res, indexName, ID)
+	}
+
+	var doc struct {
+		Document
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	return &doc.Document, nil
+}
+
+// DocumentExists checks if the document exists without loading it
+func DocumentExists(ctx context.Context, client *elasticsearch.Client, ID string, indexName string, opts *GetOptions) (bool, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+
+	req := esapi.ExistsRequest{
 		Index:      indexName,
 		DocumentID: ID,
+		Routing:    opts.Routing,
 	}
-	res, err := req.Do(context.Background(), client)
+	res, err := req.Do(ctx, client)
 	if err != nil {
-		return fmt.Errorf("error getting response: %s", err)
+		return false, fmt.Errorf("error getting response: %s", err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == 404 {
+		return false, nil
+	}
 	if res.IsError() {
-		return fmt.Errorf("[%s] Error indexing document ID=%v", res.Status(), ID)
+		return false, responseError(res, indexName, ID)
 	}
+	return true, nil
+}
 
-	return nil
+// MultiLoadByID loads all the documents using the multi get API. The
+// documents are returned in the same order as the IDs, missing documents
+// have Found set to false. Documents that failed to load have their Error
+// set, the others are still returned.
+func MultiLoadByID(ctx context.Context, client *elasticsearch.Client, IDs []string, index string, opts *GetOptions) ([]*Document, error) {
+	return MultiLoadByIDRouted(ctx, client, IDs, nil, index, opts)
 }
 
-// ElasticLoadByID Loads an item from Elastic Search
-func LoadByID(client *elasticsearch.Client, ID string, index string) ([]byte, error) {
-	query := fmt.Sprintf(`{
-		"query": {
-			"match": {
-			  "_id": "%v"
-			}
+// MultiLoadByIDRouted loads all the documents using the multi get API, each
+// with its own routing. The routings are matched to the IDs by position, an
+// empty routing falls back to the routing in the options.
+func MultiLoadByIDRouted(ctx context.Context, client *elasticsearch.Client, IDs []string, routings []string, index string, opts *GetOptions) ([]*Document, error) {
+	if len(IDs) == 0 {
+		return nil, nil
+	}
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+
+	type docRef struct {
+		ID      string `json:"_id"`
+		Routing string `json:"routing,omitempty"`
+	}
+	refs := make([]*docRef, len(IDs))
+	for i, ID := range IDs {
+		refs[i] = &docRef{ID: ID}
+		if i < len(routings) {
+			refs[i].Routing = routings[i]
 		}
-	}`, ID)
+	}
 
-	results, err := Query(client, index, query)
+	body, err := json.Marshal(map[string]interface{}{"docs": refs})
 	if err != nil {
 		return nil, err
 	}
 
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
-	value := jsonParsed.Path("hits.hits.0._source").Bytes()
-	if value == nil || string(value) == "null" {
-		return nil, nil
+	req := esapi.MgetRequest{
+		Index:          index,
+		Body:           bytes.NewReader(body),
+		Routing:        opts.Routing,
+		SourceIncludes: opts.SourceIncludes,
+		SourceExcludes: opts.SourceExcludes,
+		StoredFields:   opts.StoredFields,
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, responseError(res, index, "")
 	}
 
-	return value, err
+	var results struct {
+		Docs []*struct {
+			Document
+			Error *ErrorCause `json:"error"`
+		} `json:"docs"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	rtn := make([]*Document, len(results.Docs))
+	for i, doc := range results.Docs {
+		d := doc.Document
+		if doc.Error != nil {
+			d.Error = causeError(0, doc.Error, doc.Index, doc.ID)
+		}
+		rtn[i] = &d
+	}
+
+	return rtn, nil
+}
+
+// LoadByID Loads an item from Elastic Search. ErrNotFound is returned when
+// the item does not exist.
+func LoadByID(client *elasticsearch.Client, ID string, index string) ([]byte, error) {
+	return LoadByIDWithOptions(context.Background(), client, ID, index, nil)
+}
+
+// LoadByIDWithOptions loads the source of an item from Elastic Search,
+// restricted to the fields in the options
+func LoadByIDWithOptions(ctx context.Context, client *elasticsearch.Client, ID string, index string, opts *GetOptions) ([]byte, error) {
+	doc, err := GetDocument(ctx, client, ID, index, opts)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Source, nil
 }
 
 // ElaticSearch basic elasic search
 func Query(es *elasticsearch.Client, index string, query string) (string, error) {
+	return QueryWithOptions(context.Background(), es, index, query, nil)
+}
+
+// QueryWithOptions searches the index, returning the raw results
+func QueryWithOptions(ctx context.Context, es *elasticsearch.Client, index string, query string, opts *SearchOptions) (string, error) {
+	if opts == nil {
+		opts = &SearchOptions{}
+	}
 
 	// Issue the search
 	res, err := es.Search(
-		es.Search.WithContext(context.Background()),
+		es.Search.WithContext(ctx),
 		es.Search.WithIndex(index),
 		es.Search.WithBody(strings.NewReader(query)),
 		es.Search.WithTrackTotalHits(true),
+		es.Search.WithRouting(opts.Routing),
 		es.Search.WithPretty(),
 	)
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", responseError(res, index, "")
+	}
 
 	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -214,6 +566,11 @@ func Count(es *elasticsearch.Client, index string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return "", responseError(res, index, "")
+	}
 
 	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -223,48 +580,79 @@ func Count(es *elasticsearch.Client, index string) (string, error) {
 	return string(data), nil
 }
 
-func Hits(results string) int {
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
+// CountDocuments counts the documents matching the query without loading
+// them. The query can be a JSON string, an *ElasticSearchQueryBuilder, a
+// *datastore.SimpleQuery or nil to count all the documents
+func CountDocuments(ctx context.Context, client *elasticsearch.Client, indexName string, query interface{}, opts *SearchOptions) (int64, error) {
+	if opts == nil {
+		opts = &SearchOptions{}
+	}
+
+	body, err := byQueryBody(query)
 	if err != nil {
-		return 0
+		return 0, err
+	}
+
+	req := esapi.CountRequest{
+		Index: []string{indexName},
+		Body:  bytes.NewReader(body.Bytes()),
+	}
+	if opts.Routing != "" {
+		req.Routing = []string{opts.Routing}
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return 0, fmt.Errorf("error getting response: %s", err)
 	}
+	defer res.Body.Close()
 
-	hitsObj := jsonParsed.Path("hits.total.value")
-	if hitsObj != nil {
-		hits := hitsObj.Data().(float64)
-		return int(hits)
+	if res.IsError() {
+		return 0, responseError(res, indexName, "")
 	}
 
-	return -1
+	var result struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("error parsing the response body: %s", err)
+	}
+	return result.Count, nil
+}
+
+func Hits(results string) int {
+	res, err := ParseSearchResponse[json.RawMessage](results)
+	if err != nil {
+		return 0
+	}
+	return int(res.Total())
 }
 
 // GetIDsFromResults Gets a list of IDs from the elasic search results
 func IDsFromResults(results string) []string {
-	var rtn []string
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
+	res, err := ParseSearchResponse[json.RawMessage](results)
 	if err != nil {
-		return rtn
-	}
-	children := jsonParsed.Path("hits.hits").Children()
-	for _, item := range children {
-		id := item.S("_id").String()
-		id = strings.ReplaceAll(id, "\"", "")
-		rtn = append(rtn, id)
+		return nil
 	}
-	return rtn
+	return res.IDs()
 }
 
 func ValueFromResults(results string, name string) []string {
 	var rtn []string
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
+	res, err := ParseSearchResponse[map[string]interface{}](results)
 	if err != nil {
 		return rtn
 	}
-	children := jsonParsed.Path("hits.hits").Children()
-	for _, item := range children {
-		id := item.S("_source", name).String()
-		id = strings.ReplaceAll(id, "\"", "")
-		rtn = append(rtn, id)
+	for _, hit := range res.Hits.Hits {
+		var value interface{}
+		if hit.Source != nil {
+			value = (*hit.Source)[name]
+		}
+		if str, ok := value.(string); ok {
+			rtn = append(rtn, str)
+			continue
+		}
+		data, _ := json.Marshal(value)
+		rtn = append(rtn, strings.ReplaceAll(string(data), "\"", ""))
 	}
 	return rtn
 }
@@ -280,78 +668,67 @@ func GenerateIDQuery(ids []string) string {
 }
 
 func ToError(results string) error {
-	data, err := gabs.ParseJSON([]byte(results))
-	if err != nil {
-		return err
+	if !IsError(results) {
+		return nil
 	}
-	errorMsg := data.Path("error.root_cause.reason").String()
-	if errorMsg != "null" {
-		return fmt.Errorf("elastic error: %v", errorMsg)
+	var body errorBody
+	if err := json.Unmarshal([]byte(results), &body); err != nil {
+		return err
 	}
-
-	return nil
+	return newElasticError(body.Status, []byte(results), "", "")
 }
 
-// IsError determines if the results are an error
+// IsError reports whether the results are an error response
 func IsError(results string) bool {
-	return false
+	var body errorBody
+	if err := json.Unmarshal([]byte(results), &body); err != nil {
+		return false
+	}
+	return len(body.Error) > 0 && string(body.Error) != "null"
 }
 
 // ParseResults loads all the results as objects
 func ParseResults(results string) ([][]byte, error) {
 	var rtn [][]byte
 
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
+	res, err := ParseSearchResponse[json.RawMessage](results)
 	if err != nil {
 		return rtn, err
 	}
-	children := jsonParsed.Path("hits.hits").Children()
-	for _, item := range children {
-		source := item.S("_source").String()
-		if err != nil {
-			// record error
+	for _, source := range res.Sources() {
+		if source == nil {
+			rtn = append(rtn, []byte("null"))
 		} else {
-			rtn = append(rtn, []byte(source))
+			rtn = append(rtn, []byte(*source))
 		}
 	}
 	return rtn, nil
 }
 
 func ParseResultsTyped[T any](results string) ([]*T, error) {
-	var rtn []*T
-
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
+	res, err := ParseSearchResponse[T](results)
 	if err != nil {
-		return rtn, err
+		return nil, err
 	}
-	children := jsonParsed.Path("hits.hits").Children()
-	for _, item := range children {
-		source := item.S("_source").String()
-		if err != nil {
-			// record error
-		} else {
-			item, err := cloudy.UnmarshallT[T]([]byte(source))
-			if err != nil {
-				return nil, err
-			}
-			rtn = append(rtn, item)
+	rtn := res.Sources()
+	for i, item := range rtn {
+		if item == nil {
+			rtn[i] = new(T)
 		}
 	}
 	return rtn, nil
 }
 
 func First(results string) ([]byte, error) {
-	jsonParsed, err := gabs.ParseJSON([]byte(results))
+	res, err := ParseSearchResponse[json.RawMessage](results)
 	if err != nil {
 		return nil, err
 	}
-	children := jsonParsed.Path("hits.hits").Children()
-	if len(children) == 0 {
+	hit := res.First()
+	if hit == nil || hit.Source == nil {
 		return nil, nil
 	}
-
-	source := children[0].S("_source").Bytes()
-	return source, nil
+	return []byte(*hit.Source), nil
 }
 
 func Paths(container *gabs.Container, start string, currentPath string) []*JsonPath {
@@ -408,6 +785,98 @@ func Paths(container *gabs.Container, start string, currentPath string) []*JsonP
 	return rtn
 }
 
+// GetMappingPaths returns the paths of all the fields mapped in the index,
+// see Paths. The fields of all the indices are returned for an alias
+func GetMappingPaths(ctx context.Context, client *elasticsearch.Client, indexName string) ([]*JsonPath, error) {
+	req := esapi.IndicesGetMappingRequest{
+		Index: []string{indexName},
+	}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("error getting mapping of %v: %w", indexName, responseError(res, indexName, ""))
+	}
+
+	container, err := gabs.ParseJSONBuffer(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the response body: %s", err)
+	}
+
+	var rtn []*JsonPath
+	for _, index := range container.ChildrenMap() {
+		properties := index.S("mappings", "properties")
+		if properties != nil {
+			rtn = append(rtn, Paths(properties, "", "")...)
+		}
+	}
+	return rtn, nil
+}
+
+// GetServerVersion returns the version number of the Elastic Search
+// cluster, e.g. "7.17.9"
+func GetServerVersion(ctx context.Context, client *elasticsearch.Client) (string, error) {
+	req := esapi.InfoRequest{}
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return "", fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("error getting the cluster info: %w", responseError(res, "", ""))
+	}
+
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("error parsing the response body: %s", err)
+	}
+	return info.Version.Number, nil
+}
+
+// requireVersion returns ErrUnsupportedVersion when the cluster is older
+// than major.minor, which the feature needs
+func requireVersion(ctx context.Context, client *elasticsearch.Client, major int, minor int, feature string) error {
+	number, err := GetServerVersion(ctx, client)
+	if err != nil {
+		return err
+	}
+	ok, err := versionAtLeast(number, major, minor)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %v needs Elastic Search %v.%v or later, the cluster runs %v", ErrUnsupportedVersion, feature, major, minor, number)
+	}
+	return nil
+}
+
+// versionAtLeast reports whether the version number, e.g. "7.17.9" or
+// "8.0.0-SNAPSHOT", is major.minor or later
+func versionAtLeast(number string, major int, minor int) (bool, error) {
+	parts := strings.SplitN(number, ".", 3)
+	if len(parts) < 2 {
+		return false, fmt.Errorf("invalid version number %v", number)
+	}
+	actualMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid version number %v", number)
+	}
+	actualMinor, err := strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid version number %v", number)
+	}
+	if actualMajor != major {
+		return actualMajor > major, nil
+	}
+	return actualMinor >= minor, nil
+}
+
 type JsonPath struct {
 	Path string
 	Type string
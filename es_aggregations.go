@@ -0,0 +1,352 @@
+package cloudyelastic
+
+import (
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// The kinds of metric aggregations, see NewMetricAggregation
+const (
+	MetricAvg        = "avg"
+	MetricSum        = "sum"
+	MetricMin        = "min"
+	MetricMax        = "max"
+	MetricStats      = "stats"
+	MetricValueCount = "value_count"
+)
+
+// Aggregation is a single aggregation of a query. The results are read with
+// the matching method of AggregationResults
+type Aggregation interface {
+	Build() map[string]interface{}
+}
+
+// Aggregations are the aggregations of a query or of a bucket, by name
+type Aggregations map[string]Aggregation
+
+func (aggs Aggregations) Build() map[string]interface{} {
+	rtn := make(map[string]interface{}, len(aggs))
+	for name, agg := range aggs {
+		rtn[name] = agg.Build()
+	}
+	return rtn
+}
+
+// AddAggregation adds a top level aggregation to the query
+func (es *ElasticSearchQueryBuilder) AddAggregation(name string, agg Aggregation) {
+	if es.Aggregations == nil {
+		es.Aggregations = make(Aggregations)
+	}
+	es.Aggregations[name] = agg
+}
+
+// SubAggregations are the aggregations computed for every bucket of a bucket
+// aggregation
+type SubAggregations struct {
+	Aggregations Aggregations
+}
+
+// AddAggregation adds an aggregation computed for every bucket
+func (s *SubAggregations) AddAggregation(name string, agg Aggregation) {
+	if s.Aggregations == nil {
+		s.Aggregations = make(Aggregations)
+	}
+	s.Aggregations[name] = agg
+}
+
+func (s *SubAggregations) build(kind string, body map[string]interface{}) map[string]interface{} {
+	rtn := map[string]interface{}{
+		kind: body,
+	}
+	if len(s.Aggregations) > 0 {
+		rtn["aggs"] = s.Aggregations.Build()
+	}
+	return rtn
+}
+
+// ---------------
+
+// TermsAggregation groups the documents by the values of the field, read
+// with AggregationResults.Buckets
+type TermsAggregation struct {
+	SubAggregations
+	Field string
+	// Number of buckets returned. Defaults to 10
+	Size        int
+	MinDocCount *int
+	// Value used for the documents without the field
+	Missing interface{}
+	// Orders the buckets, e.g. by "_count", "_key" or a metric sub-aggregation
+	OrderBy   string
+	Direction string
+}
+
+func NewTermsAggregation(field string) *TermsAggregation {
+	return &TermsAggregation{Field: field}
+}
+
+func (a *TermsAggregation) Build() map[string]interface{} {
+	body := map[string]interface{}{
+		"field": a.Field,
+	}
+	if a.Size > 0 {
+		body["size"] = a.Size
+	}
+	if a.MinDocCount != nil {
+		body["min_doc_count"] = *a.MinDocCount
+	}
+	if a.Missing != nil {
+		body["missing"] = a.Missing
+	}
+	if a.OrderBy != "" {
+		body["order"] = map[string]interface{}{
+			a.OrderBy: strings.ToLower(orDefault(a.Direction, "desc")),
+		}
+	}
+	return a.build("terms", body)
+}
+
+// HistogramAggregation groups numeric values in buckets of a fixed interval,
+// read with AggregationResults.Buckets
+type HistogramAggregation struct {
+	SubAggregations
+	Field       string
+	Interval    float64
+	Offset      float64
+	MinDocCount *int
+}
+
+func NewHistogramAggregation(field string, interval float64) *HistogramAggregation {
+	return &HistogramAggregation{Field: field, Interval: interval}
+}
+
+func (a *HistogramAggregation) Build() map[string]interface{} {
+	body := map[string]interface{}{
+		"field":    a.Field,
+		"interval": a.Interval,
+	}
+	if a.Offset != 0 {
+		body["offset"] = a.Offset
+	}
+	if a.MinDocCount != nil {
+		body["min_doc_count"] = *a.MinDocCount
+	}
+	return a.build("histogram", body)
+}
+
+// DateHistogramAggregation groups dates in buckets, read with
+// AggregationResults.Buckets. Set either CalendarInterval, e.g. "1d" or
+// "month", or FixedInterval, e.g. "90m"
+type DateHistogramAggregation struct {
+	SubAggregations
+	Field            string
+	CalendarInterval string
+	FixedInterval    string
+	// Format of the keys as string, e.g. "yyyy-MM-dd"
+	Format      string
+	TimeZone    string
+	MinDocCount *int
+}
+
+func NewDateHistogramAggregation(field string, calendarInterval string) *DateHistogramAggregation {
+	return &DateHistogramAggregation{Field: field, CalendarInterval: calendarInterval}
+}
+
+func (a *DateHistogramAggregation) Build() map[string]interface{} {
+	body := map[string]interface{}{
+		"field": a.Field,
+	}
+	if a.CalendarInterval != "" {
+		body["calendar_interval"] = a.CalendarInterval
+	}
+	if a.FixedInterval != "" {
+		body["fixed_interval"] = a.FixedInterval
+	}
+	if a.Format != "" {
+		body["format"] = a.Format
+	}
+	if a.TimeZone != "" {
+		body["time_zone"] = a.TimeZone
+	}
+	if a.MinDocCount != nil {
+		body["min_doc_count"] = *a.MinDocCount
+	}
+	return a.build("date_histogram", body)
+}
+
+// AggregationRange is a bucket of a range aggregation. From is inclusive and
+// To exclusive, either can be nil for an unbounded range
+type AggregationRange struct {
+	Key  string
+	From interface{}
+	To   interface{}
+}
+
+// RangeAggregation groups the documents in the ranges, read with
+// AggregationResults.Buckets
+type RangeAggregation struct {
+	SubAggregations
+	Field  string
+	Ranges []*AggregationRange
+}
+
+func NewRangeAggregation(field string) *RangeAggregation {
+	return &RangeAggregation{Field: field}
+}
+
+// AddRange adds a bucket for the range
+func (a *RangeAggregation) AddRange(key string, from interface{}, to interface{}) {
+	a.Ranges = append(a.Ranges, &AggregationRange{Key: key, From: from, To: to})
+}
+
+func (a *RangeAggregation) Build() map[string]interface{} {
+	ranges := make([]interface{}, len(a.Ranges))
+	for i, r := range a.Ranges {
+		rng := make(map[string]interface{})
+		if r.Key != "" {
+			rng["key"] = r.Key
+		}
+		if r.From != nil {
+			rng["from"] = r.From
+		}
+		if r.To != nil {
+			rng["to"] = r.To
+		}
+		ranges[i] = rng
+	}
+	return a.build("range", map[string]interface{}{
+		"field":  a.Field,
+		"ranges": ranges,
+	})
+}
+
+// FiltersAggregation has a bucket per query, read with
+// AggregationResults.Buckets. The bucket keys are the names of the filters
+type FiltersAggregation struct {
+	SubAggregations
+	Filters map[string]*QueryBuilder
+	// Adds a bucket for the documents matching none of the filters
+	OtherBucket    bool
+	OtherBucketKey string
+}
+
+func NewFiltersAggregation() *FiltersAggregation {
+	return &FiltersAggregation{Filters: make(map[string]*QueryBuilder)}
+}
+
+// AddFilter adds a bucket for the documents matching the returned query
+func (a *FiltersAggregation) AddFilter(name string) *QueryBuilder {
+	if a.Filters == nil {
+		a.Filters = make(map[string]*QueryBuilder)
+	}
+	qb := NewQueryBuilder()
+	a.Filters[name] = qb
+	return qb
+}
+
+func (a *FiltersAggregation) Build() map[string]interface{} {
+	filters := make(map[string]interface{}, len(a.Filters))
+	for name, qb := range a.Filters {
+		if qb == nil || !qb.Valid() {
+			filters[name] = map[string]interface{}{"match_all": struct{}{}}
+			continue
+		}
+		container := gabs.New()
+		qb.Build(container)
+		filters[name] = container.S("query").Data()
+	}
+	body := map[string]interface{}{
+		"filters": filters,
+	}
+	if a.OtherBucket {
+		body["other_bucket"] = true
+	}
+	if a.OtherBucketKey != "" {
+		body["other_bucket_key"] = a.OtherBucketKey
+	}
+	return a.build("filters", body)
+}
+
+// ---------------
+
+// MetricAggregation computes a single metric over the values of the field.
+// MetricStats is read with AggregationResults.Stats, the others with
+// AggregationResults.Value
+type MetricAggregation struct {
+	Kind  string
+	Field string
+	// Value used for the documents without the field
+	Missing interface{}
+}
+
+func NewMetricAggregation(kind string, field string) *MetricAggregation {
+	return &MetricAggregation{Kind: kind, Field: field}
+}
+
+func (a *MetricAggregation) Build() map[string]interface{} {
+	body := map[string]interface{}{
+		"field": a.Field,
+	}
+	if a.Missing != nil {
+		body["missing"] = a.Missing
+	}
+	return map[string]interface{}{
+		a.Kind: body,
+	}
+}
+
+// CardinalityAggregation approximates the number of distinct values of the
+// field, read with AggregationResults.Value
+type CardinalityAggregation struct {
+	Field string
+	// Counts below the threshold are expected to be close to accurate
+	PrecisionThreshold int
+}
+
+func NewCardinalityAggregation(field string) *CardinalityAggregation {
+	return &CardinalityAggregation{Field: field}
+}
+
+func (a *CardinalityAggregation) Build() map[string]interface{} {
+	body := map[string]interface{}{
+		"field": a.Field,
+	}
+	if a.PrecisionThreshold > 0 {
+		body["precision_threshold"] = a.PrecisionThreshold
+	}
+	return map[string]interface{}{
+		"cardinality": body,
+	}
+}
+
+// PercentilesAggregation approximates the percentiles of the values of the
+// field, read with AggregationResults.Percentiles
+type PercentilesAggregation struct {
+	Field string
+	// Defaults to 1, 5, 25, 50, 75, 95 and 99
+	Percents []float64
+}
+
+func NewPercentilesAggregation(field string, percents ...float64) *PercentilesAggregation {
+	return &PercentilesAggregation{Field: field, Percents: percents}
+}
+
+func (a *PercentilesAggregation) Build() map[string]interface{} {
+	body := map[string]interface{}{
+		"field": a.Field,
+	}
+	if len(a.Percents) > 0 {
+		body["percents"] = a.Percents
+	}
+	return map[string]interface{}{
+		"percentiles": body,
+	}
+}
+
+func orDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -2,17 +2,22 @@ package cloudyelastic
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/Jeffail/gabs/v2"
 )
 
 type ElasticSearchQueryBuilder struct {
-	Size     int
-	From     int
-	Source   []string
-	NoSource bool
-	Sort     []*Sort
-	Query    *QueryBuilder
+	Size      int
+	From      int
+	Source    []string
+	NoSource  bool
+	Sort      []*Sort
+	Query     *QueryBuilder
+	Highlight *Highlight
+	// Aggregations computed over the matching documents, see
+	// SearchResponse.AggregationResults
+	Aggregations Aggregations
 }
 
 type Builder interface {
@@ -86,6 +91,18 @@ func (es *ElasticSearchQueryBuilder) BuildContainer() *gabs.Container {
 	if es.Query != nil && es.Query.Valid() {
 		es.Query.Build(root)
 	}
+
+	for _, sort := range es.Sort {
+		root.ArrayAppend(sort.Build(), "sort")
+	}
+
+	if es.Highlight != nil && len(es.Highlight.Fields) > 0 {
+		root.Set(es.Highlight.Build(), "highlight")
+	}
+
+	if len(es.Aggregations) > 0 {
+		root.Set(es.Aggregations.Build(), "aggs")
+	}
 	return root
 }
 
@@ -99,16 +116,104 @@ func (es *ElasticSearchQueryBuilder) SetSort(field string, direction string) {
 	}
 }
 
+// AddHighlight highlights the matches in the field. The options of the
+// returned field override the ones of es.Highlight
+func (es *ElasticSearchQueryBuilder) AddHighlight(field string) *HighlightField {
+	if es.Highlight == nil {
+		es.Highlight = &Highlight{}
+	}
+	return es.Highlight.AddField(field)
+}
+
 type Sort struct {
 	field     string
 	direction string
 }
 
+func (s *Sort) Build() map[string]interface{} {
+	return map[string]interface{}{
+		s.field: map[string]interface{}{
+			"order": strings.ToLower(s.direction),
+		},
+	}
+}
+
+// ---------------
+
+// Highlight configures the highlighting of the matches in the hits. The
+// fragments are returned in SearchHit.Highlight
+type Highlight struct {
+	Fields []*HighlightField
+	// Highlighter to use: "unified" (default), "plain" or "fvh"
+	Type string
+	// Size of the fragments in characters. Defaults to 100
+	FragmentSize int
+	// Maximum number of fragments per field. Defaults to 5, 0 returns the
+	// whole field
+	NumberOfFragments *int
+	// Tags around the highlighted text. Default to <em> and </em>
+	PreTags  []string
+	PostTags []string
+}
+
+// HighlightField is a highlighted field, with the options that differ from
+// the ones of the highlight
+type HighlightField struct {
+	Name              string
+	Type              string
+	FragmentSize      int
+	NumberOfFragments *int
+	PreTags           []string
+	PostTags          []string
+}
+
+// AddField highlights matches in the field
+func (h *Highlight) AddField(field string) *HighlightField {
+	f := &HighlightField{Name: field}
+	h.Fields = append(h.Fields, f)
+	return f
+}
+
+func (h *Highlight) Build() map[string]interface{} {
+	rtn := highlightOptions(h.Type, h.FragmentSize, h.NumberOfFragments, h.PreTags, h.PostTags)
+	fields := make(map[string]interface{})
+	for _, f := range h.Fields {
+		fields[f.Name] = f.Build()
+	}
+	rtn["fields"] = fields
+	return rtn
+}
+
+func (f *HighlightField) Build() map[string]interface{} {
+	return highlightOptions(f.Type, f.FragmentSize, f.NumberOfFragments, f.PreTags, f.PostTags)
+}
+
+func highlightOptions(highlighter string, fragmentSize int, numberOfFragments *int, preTags []string, postTags []string) map[string]interface{} {
+	rtn := make(map[string]interface{})
+	if highlighter != "" {
+		rtn["type"] = highlighter
+	}
+	if fragmentSize > 0 {
+		rtn["fragment_size"] = fragmentSize
+	}
+	if numberOfFragments != nil {
+		rtn["number_of_fragments"] = *numberOfFragments
+	}
+	if len(preTags) > 0 {
+		rtn["pre_tags"] = preTags
+	}
+	if len(postTags) > 0 {
+		rtn["post_tags"] = postTags
+	}
+	return rtn
+}
+
 // ---------------
 
 type QueryBuilder struct {
 	Bool           *BooleanCollector
 	MatchAll       bool
+	MatchNone      bool
 	MatchCondition *MatchCondition
 	RangeCondition *RangeCondition
 	Collector      *ConditionCollector
@@ -136,12 +241,14 @@ func (qb *QueryBuilder) Build(parent *gabs.Container) {
 		qb.MatchCondition.Build(query)
 	} else if qb.MatchAll {
 		query.Set(q, "match_all")
+	} else if qb.MatchNone {
+		query.Set(q, "match_none")
 	}
 	parent.Set(query, "query")
 }
 
 func (qb *QueryBuilder) Valid() bool {
-	return (qb.Bool != nil && qb.Bool.Valid()) || (qb.MatchCondition != nil) || qb.MatchAll
+	return (qb.Bool != nil && qb.Bool.Valid()) || (qb.MatchCondition != nil) || qb.MatchAll || qb.MatchNone
 }
 
 // ---------------
@@ -223,9 +223,3 @@ package cloudyelastic
 // 	}
 // 	return rangeCond
 // }
-
-// type AggParser struct{}
-
-// func (p AggParser) Parse(jsonParsed *gabs.Container, q ElasticSearchQueryBuilder) {
-
-// }
@@ -2,6 +2,7 @@ package cloudyelastic
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/elastic/go-elasticsearch/v7"
@@ -11,6 +12,15 @@ type ESIndexer struct {
 	IndexName    string
 	Client       *elasticsearch.Client
 	SkipIndexing bool
+	Bulk         *BulkOptions
+
+	// Refresh policy of all the writes. Defaults to RefreshImmediate and can be
+	// overridden per call with WithRefresh or WithWriteOptions
+	Refresh RefreshPolicy
+
+	// Checks the documents before they are indexed. Invalid documents are
+	// rejected with a ValidationError
+	Validation *DocumentValidation
 }
 
 func NewIndexer(index string, skipIndexing bool) *ESIndexer {
@@ -48,7 +58,23 @@ func (es *ESIndexer) Close(ctx context.Context) error {
 
 func (es *ESIndexer) Index(ctx context.Context, id string, data []byte) error {
 	if !es.SkipIndexing {
-		err := IndexData(es.Client, data, id, es.IndexName)
+		if err := es.Validation.ValidateDocument(id, data); err != nil {
+			return err
+		}
+		_, err := IndexDataWithOptions(ctx, es.Client, data, id, es.IndexName, es.writeOptions(ctx))
+		return err
+	}
+	return nil
+}
+
+// Create indexes the data only if there is no document with the same id.
+// Otherwise ErrAlreadyExists is returned
+func (es *ESIndexer) Create(ctx context.Context, id string, data []byte) error {
+	if !es.SkipIndexing {
+		if err := es.Validation.ValidateDocument(id, data); err != nil {
+			return err
+		}
+		_, err := CreateData(ctx, es.Client, data, id, es.IndexName, es.writeOptions(ctx))
 		return err
 	}
 	return nil
@@ -56,12 +82,97 @@ func (es *ESIndexer) Index(ctx context.Context, id string, data []byte) error {
 
 func (es *ESIndexer) Remove(ctx context.Context, id string) error {
 	if !es.SkipIndexing {
-		err := RemoveData(es.Client, id, es.IndexName)
+		_, err := RemoveDataWithOptions(ctx, es.Client, id, es.IndexName, es.writeOptions(ctx))
 		return err
 	}
 	return nil
 }
 
+// IndexMany indexes all the documents using the bulk API. The ids and data
+// are matched by position. The external version of WithExternalVersion
+// applies to every document
+func (es *ESIndexer) IndexMany(ctx context.Context, ids []string, data [][]byte) (*BulkResult, error) {
+	if !es.SkipIndexing {
+		if err := es.validateMany(ids, data); err != nil {
+			return nil, err
+		}
+		return Bulk(ctx, es.Client, es.IndexName, es.bulkItems(ctx, BulkActionIndex, ids, data), es.bulkOptions(ctx))
+	}
+	return &BulkResult{}, nil
+}
+
+// CreateMany indexes the documents whose ids do not exist yet. The ids that
+// already existed are reported by BulkResult.Existing. Create-only writes
+// cannot be externally versioned
+func (es *ESIndexer) CreateMany(ctx context.Context, ids []string, data [][]byte) (*BulkResult, error) {
+	if !es.SkipIndexing {
+		if err := es.validateMany(ids, data); err != nil {
+			return nil, err
+		}
+		if writeOptionsFromContext(ctx).Version != nil {
+			return nil, errors.New("create-only writes cannot be externally versioned")
+		}
+		return BulkCreateData(ctx, es.Client, es.IndexName, ids, data, es.bulkOptions(ctx))
+	}
+	return &BulkResult{}, nil
+}
+
+// RemoveMany removes all the documents using the bulk API. The external
+// version of WithExternalVersion applies to every document
+func (es *ESIndexer) RemoveMany(ctx context.Context, ids []string) (*BulkResult, error) {
+	if !es.SkipIndexing {
+		return Bulk(ctx, es.Client, es.IndexName, es.bulkItems(ctx, BulkActionDelete, ids, nil), es.bulkOptions(ctx))
+	}
+	return &BulkResult{}, nil
+}
+
 func (es *ESIndexer) Search(ctx context.Context, query interface{}) (interface{}, error) {
-	return Query(es.Client, es.IndexName, query.(string))
+	return QueryWithOptions(ctx, es.Client, es.IndexName, query.(string), &SearchOptions{
+		Routing: routingFromContext(ctx),
+	})
+}
+
+func (es *ESIndexer) writeOptions(ctx context.Context) *WriteOptions {
+	return resolveWriteOptions(ctx, es.Refresh)
+}
+
+func (es *ESIndexer) bulkOptions(ctx context.Context) *BulkOptions {
+	bulkOpts := resolveBulkOptions(ctx, es.Bulk, es.Refresh)
+	if bulkOpts.Routing == "" {
+		bulkOpts.Routing = routingFromContext(ctx)
+	}
+	return bulkOpts
+}
+
+// bulkItems builds the bulk items of the documents, with the external
+// version of the context if any. The data is nil for deletes
+func (es *ESIndexer) bulkItems(ctx context.Context, action string, ids []string, data [][]byte) []*BulkItem {
+	opts := writeOptionsFromContext(ctx)
+	items := make([]*BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = &BulkItem{
+			Action:      action,
+			ID:          id,
+			Version:     opts.Version,
+			VersionType: opts.VersionType,
+		}
+		if data != nil {
+			items[i].Data = data[i]
+		}
+	}
+	return items
+}
+
+// validateMany validates all the documents of a bulk write, nothing is sent
+// unless every document is valid
+func (es *ESIndexer) validateMany(ids []string, data [][]byte) error {
+	if len(ids) != len(data) {
+		return fmt.Errorf("mismatched bulk request, %v ids and %v documents", len(ids), len(data))
+	}
+	for i, id := range ids {
+		if err := es.Validation.ValidateDocument(id, data[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }